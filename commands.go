@@ -0,0 +1,2777 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// handler runs a command with its arguments in transaction t.
+type handler func(t *transaction, args []string) error
+
+// command describes a REPL command.
+type command struct {
+	name        string
+	synopsis    string // arguments, as shown in the usage message
+	minArgs     int
+	maxArgs     int // -1 if there is no limit
+	description string
+	handler     handler
+
+	// control is set for commands that start or end transactions or
+	// otherwise cannot be part of a TRANSACTION batch.
+	control bool
+
+	// mutating is set for commands that can change the store. They are
+	// rejected under -read-only, unless replicates is set too.
+	mutating bool
+
+	// replicates is set for the commands that apply a recording, which
+	// feed a replica running with -read-only.
+	replicates bool
+}
+
+// commands lists every REPL command, grouped as in the usage message.
+var commands [][]command
+
+// commandIndex maps command names to their entry in commands.
+var commandIndex = make(map[string]command)
+
+// errNotInTransaction is returned by commands that need an open transaction.
+var errNotInTransaction = errorf(ERR_TXN, "Error: you are not currently in a transaction")
+
+func init() {
+	commands = [][]command{
+		{
+			{name: READ, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print value of <key>", handler: handleRead},
+			{name: READDEFAULT, synopsis: "<key> <default>", minArgs: 2, maxArgs: -1,
+				description: "Print value of <key>, or <default> if it is unset", handler: handleReadDefault},
+			{name: READB64, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print value of <key> base64 encoded", handler: handleReadB64},
+			{name: CHECKSUM, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print the SHA-256 digest of the value of <key> in hex", handler: handleChecksum},
+			{name: VERIFY, synopsis: "<key> <sha256>", minArgs: 2, maxArgs: 2,
+				description: "Print 1 if the SHA-256 digest of the value of <key> is <sha256>, 0 otherwise", handler: handleVerify},
+			{name: READMETA, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print value of <key> with its type and lock state as JSON", handler: handleReadMeta},
+			{name: HOTKEYS, synopsis: "<n>", minArgs: 1, maxArgs: 1,
+				description: "Print the <n> keys read most since start, with their counts (needs -count-access)", handler: handleHotKeys},
+			{name: RENDER, synopsis: "<key> [STRICT]", minArgs: 1, maxArgs: 2,
+				description: "Print value of <key> with each ${<key>} replaced by its rendered value", handler: handleRender},
+			{name: HISTORY, synopsis: "[<key>]", maxArgs: 1,
+				description: "Print the committed values <key> had before its current one, newest first, or the last commands run",
+				handler:     handleHistory},
+			{name: WRITE, synopsis: "<key> <value>|<<<end>|@<file> [REPORT]", minArgs: 1, maxArgs: 3,
+				description: "Store <value>, the lines up to <end>, or the contents of file <value> if it starts with @, in <key>",
+				handler:     handleWrite, mutating: true},
+			{name: WRITEB64, synopsis: "<key> <base64>", minArgs: 2, maxArgs: 2,
+				description: "Store the bytes encoded by <base64> in <key>", handler: handleWriteB64, mutating: true},
+			{name: WRITEIFCHANGED, synopsis: "<key> <value>", minArgs: 2, maxArgs: 2,
+				description: "Store <value> in <key> unless it is already there, printing 1 if stored or 0", handler: handleWriteIfChanged, mutating: true},
+			{name: INSERT, description: "Store the <key> <value> pairs on the lines up to one with only . (or discard them on ABORT)",
+				handler: handleInsert, mutating: true},
+			{name: DELETE, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Delete <key>", handler: handleDelete, mutating: true},
+			{name: DELIF, synopsis: "<key> <expected>", minArgs: 2, maxArgs: 2,
+				description: "Delete <key> if its value is <expected>, printing 1 if it was deleted", handler: handleDelIf, mutating: true},
+			{name: SNAPKEY, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Save the value of <key> for RESTOREKEY", handler: handleSnapKey},
+			{name: RESTOREKEY, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Give <key> back the value saved by SNAPKEY", handler: handleRestoreKey, mutating: true},
+			{name: RENAMENX, synopsis: "<old> <new>", minArgs: 2, maxArgs: 2,
+				description: "Rename <old> to <new> unless <new> exists, printing 1 if renamed or 0", handler: handleRenameNX, mutating: true},
+			{name: RENAMEPREFIX, synopsis: "<old> <new>", minArgs: 2, maxArgs: 2,
+				description: "Replace prefix <old> by <new> in every key, printing how many, unless a key would be overwritten", handler: handleRenamePrefix, mutating: true},
+			{name: LOCK, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Reject every change to <key> until UNLOCK, in and out of transactions", handler: handleLock},
+			{name: UNLOCK, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Allow changes to <key> again", handler: handleUnlock},
+			{name: SWAP, synopsis: "<key1> <key2>", minArgs: 2, maxArgs: 2,
+				description: "Exchange the values of <key1> and <key2>", handler: handleSwap, mutating: true},
+			{name: LINK, synopsis: "<dst> <src>", minArgs: 2, maxArgs: 2,
+				description: "Write the current value of <src> to <dst>, once", handler: handleLink, mutating: true},
+			{name: FLUSHALL, synopsis: "[CONFIRM]", maxArgs: 1,
+				description: "Delete every key, asking first unless CONFIRM is given", handler: handleFlushAll, mutating: true},
+			{name: TRIM, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Strip surrounding whitespace from the value of <key>", handler: handleTrim, mutating: true},
+			{name: UPPER, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Upper-case the value of <key>", handler: handleUpper, mutating: true},
+			{name: LOWER, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Lower-case the value of <key>", handler: handleLower, mutating: true},
+			{name: TRUNCATE, synopsis: "<key> <length>", minArgs: 2, maxArgs: 2,
+				description: "Shorten the value of <key> to <length> runes", handler: handleTruncate, mutating: true},
+			{name: NEXTID, synopsis: "<key> <n>", minArgs: 2, maxArgs: 2,
+				description: "Add <n> to the integer value of <key>, 0 if unset, printing the value before", handler: handleNextID, mutating: true},
+			{name: DECRBY, synopsis: "<key> <amount>", minArgs: 2, maxArgs: 2,
+				description: "Subtract <amount> from the integer value of <key>, 0 if unset, printing the result", handler: handleDecrBy, mutating: true},
+			{name: PIPE, synopsis: "<key> <program> [<arg>...]", minArgs: 2, maxArgs: -1,
+				description: "Replace the value of <key> with the output of <program> given it as input (needs -allow-exec)", handler: handlePipe, mutating: true},
+			{name: MAPVALUES, synopsis: "<pattern> TRIM|UPPER|LOWER", minArgs: 2, maxArgs: 2,
+				description: "Apply TRIM, UPPER or LOWER to the value of every key matching <pattern>, printing how many changed", handler: handleMapValues, mutating: true},
+			{name: EVAL, synopsis: "<key> = <expr>", minArgs: 3, maxArgs: -1,
+				description: "Store in <key> the integer result of <expr>, using + - * / ( ) and other keys", handler: handleEval, mutating: true},
+			{name: SUBSTR, synopsis: "<key> <start> <end>", minArgs: 3, maxArgs: 3,
+				description: "Print runes [<start>, <end>) of the value of <key>", handler: handleSubstr},
+			{name: GREP, synopsis: "[-i] <substring>", minArgs: 1, maxArgs: 2,
+				description: "Print keys and values whose value contains <substring>", handler: handleGrep},
+			{name: MATCH, synopsis: "<regex>", minArgs: 1, maxArgs: 1,
+				description: "Print keys whose value matches <regex>", handler: handleMatch},
+			{name: READPREFIX, synopsis: "[<prefix>]", maxArgs: 1,
+				description: "Print keys starting with <prefix>, or all keys, with their values", handler: handleReadPrefix},
+			{name: SORTBYVALUE, synopsis: "[NUMERIC] [DESC] [STRICT]", maxArgs: 3,
+				description: "Print keys and values sorted by value, as numbers with NUMERIC", handler: handleSortByValue},
+			{name: COUNTPREFIX, synopsis: "[<prefix>]", maxArgs: 1,
+				description: "Print the number of keys starting with <prefix>, or of all keys", handler: handleCountPrefix},
+			{name: RANGESUM, synopsis: "<prefix> [STRICT]", minArgs: 1, maxArgs: 2,
+				description: "Print the total, count, min and max of the integer values of keys starting with <prefix>", handler: handleRangeSum},
+			{name: KEYSLINE, synopsis: "[<separator>]", maxArgs: 1,
+				description: "Print every key on one line, joined by <separator>, which cannot hold ;, or a space", handler: handleKeysLine},
+			{name: KEYAT, synopsis: "<index>", minArgs: 1, maxArgs: 1,
+				description: "Print the key at <index> in sorted order, counting from the end if negative", handler: handleKeyAt},
+			{name: SCAN, synopsis: "<cursor> [MATCH <pattern>] [COUNT <count>]", minArgs: 1, maxArgs: 5,
+				description: "Print the next cursor and the keys among the next <count> that match <pattern>", handler: handleScan},
+			{name: SCANVALUES, synopsis: "<cursor> <count>", minArgs: 2, maxArgs: 2,
+				description: "Print the next cursor and the next <count> keys with their values", handler: handleScanValues},
+			{name: ASSERT, synopsis: "<key> <expected>", minArgs: 2, maxArgs: 2,
+				description: "Fail, and make the program exit with status 1, unless <key> is <expected>", handler: handleAssert},
+			{name: REQUIRE, synopsis: "<key>...", minArgs: 1, maxArgs: -1,
+				description: "Fail, and make the program exit with status 1, unless every <key> is set", handler: handleRequire},
+			{name: WAITFOR, synopsis: "<key> <seconds>", minArgs: 2, maxArgs: 2,
+				description: "Print the value of <key>, or fail without waiting if it is unset", handler: handleWaitFor},
+			{name: WAITSIZE, synopsis: "<n> <seconds>", minArgs: 2, maxArgs: 2,
+				description: "Print the number of keys, or fail without waiting if there are fewer than <n>", handler: handleWaitSize},
+		},
+		{
+			{name: START, description: "Start a transaction", handler: handleStart, control: true},
+			{name: COMMIT, synopsis: "[<levels>] [IFCHANGED]", maxArgs: 2,
+				description: "Commit transaction, and <levels>-1 enclosing ones, or with IFCHANGED abort them if they changed nothing",
+				handler:     handleCommit, control: true},
+			{name: ABORT, description: "Abort transaction", handler: handleAbort, control: true},
+			{name: TXNDUMP, description: "Print the keys added (+), modified (~), and deleted (-) by the transaction",
+				handler: handleTxnDump},
+			{name: TXNDIFF, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Print the keys the transaction would make added (+), modified (~), and deleted (-) from those saved in <file> by DUMPJSON", handler: handleTxnDiff},
+			{name: EXPORTTXN, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Write the changes of the transaction to <file> as commands between START and COMMIT", handler: handleExportTxn},
+			{name: WHERE, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print the depth whose write gave <key> its value, and whether it is pending, inherited, or committed", handler: handleWhere},
+			{name: TRACE, synopsis: "<key>", minArgs: 1, maxArgs: 1,
+				description: "Print what each transaction level, from the current one outwards, did to <key>", handler: handleTrace},
+			{name: TRANSACTION, synopsis: "<cmd>; <cmd>; ...", minArgs: 1, maxArgs: -1,
+				description: "Run commands atomically", handler: handleTransaction, control: true},
+			{name: MULTI, description: "Queue the following commands until EXEC or DISCARD", handler: handleMulti, control: true},
+			{name: EXEC, description: "Run the queued commands atomically", handler: handleExec, control: true},
+			{name: DISCARD, description: "Drop the queued commands", handler: handleDiscard, control: true},
+		},
+		{
+			{name: DUMPJSON, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Write every key with its type and value to <file> as JSON", handler: handleDumpJSON},
+			{name: SAVEMATCH, synopsis: "<pattern> <file>", minArgs: 2, maxArgs: 2,
+				description: "Write the keys matching <pattern> to <file> like DUMPJSON, printing how many", handler: handleSaveMatch},
+			{name: EXPORTSORTED, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Write every key=value to <file>, sorted and escaped for stable diffs, printing how many", handler: handleExportSorted},
+			{name: EXPORTGO, synopsis: "<name> <file>", minArgs: 2, maxArgs: 2,
+				description: "Write the store to <file> as a Go map[string]string variable <name>, printing how many keys", handler: handleExportGo},
+			{name: LOADJSON, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Replace the store by the contents of a DUMPJSON <file>", handler: handleLoadJSON, mutating: true},
+			{name: DRYLOAD, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Print the changes LOADJSON <file> would make, without making them", handler: handleDryLoad},
+			{name: REPLAY, synopsis: "<file>", minArgs: 1, maxArgs: 1,
+				description: "Apply the mutations in a RECORD <file> and print how many", handler: handleReplay, mutating: true, replicates: true},
+		},
+		{
+			{name: RECORD, synopsis: "<file>|STOP", minArgs: 1, maxArgs: 1,
+				description: "Append committed WRITE/DELETE commands to <file>, or stop", handler: handleRecord, control: true},
+			{name: COMPACT, description: "Rewrite the RECORD file as a WRITE of each key, printing its old and new sizes",
+				handler: handleCompact, control: true},
+			{name: CHECK, description: "Compare the store with a replay of the RECORD file, printing the mismatches",
+				handler: handleCheck},
+			{name: PAUSE, description: "Reject the commands that change the store until RESUME", handler: handlePause},
+			{name: RESUME, description: "Accept the commands that change the store again", handler: handleResume},
+			{name: ONMISSING, synopsis: "ERROR|EMPTY|SILENT", minArgs: 1, maxArgs: 1,
+				description: "Set whether READ of an unset key fails, prints an empty line or prints nothing", handler: handleOnMissing},
+			{name: ECHOMODE, synopsis: "ON|OFF", minArgs: 1, maxArgs: 1,
+				description: "Start or stop writing each command to stderr before running it", handler: handleEchoMode},
+			{name: RECONFIG, synopsis: "<setting> <value>", minArgs: 2, maxArgs: 2,
+				description: "Set the command line flag <setting> to <value>", handler: handleReconfig},
+			{name: MEMUSAGE, description: "Print the estimated bytes used by the store", handler: handleMemUsage},
+			{name: INFO, description: "Print a summary of the store and the session", handler: handleInfo},
+			{name: UPTIME, description: "Print when the program started and how long ago", handler: handleUptime},
+			{name: MARK, description: "Remember the number of keys for DELTA", handler: handleMark},
+			{name: DELTA, description: "Print how many keys were added (+) or removed (-) since MARK", handler: handleDelta},
+			{name: METRICS, synopsis: "JSON", minArgs: 1, maxArgs: 1,
+				description: "Print the session metrics and the count of each command as JSON", handler: handleMetrics},
+			{name: LIMITS, description: "Print the limits on keys, values, and nesting in force", handler: handleLimits},
+			{name: CONSISTENCY, description: "Print the consistency guarantee in force", handler: handleConsistency},
+			{name: COMMAND, description: "Print every command with its argument counts", handler: handleCommand},
+			{name: DISABLED, description: "Print the commands rejected by the current settings, with the reason", handler: handleDisabled},
+			{name: QUIT, description: "Exit program", handler: handleQuit, control: true},
+		},
+	}
+
+	for _, group := range commands {
+		for _, c := range group {
+			commandIndex[c.name] = c
+		}
+	}
+}
+
+// usage returns the usage message for this program.
+func usage() string {
+	var b strings.Builder
+	b.WriteString("\n\n    Available commands:\n    -------------------\n")
+	for i, group := range commands {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, c := range group {
+			name := strings.TrimSpace(c.name + " " + c.synopsis)
+			if len(name) > 20 {
+				fmt.Fprintf(&b, "    %s\n    %-20s %s\n", name, "", c.description)
+			} else {
+				fmt.Fprintf(&b, "    %-20s %s\n", name, c.description)
+			}
+		}
+	}
+	b.WriteString("\n    Aliases: " + aliases.String() + "\n")
+	return b.String()
+}
+
+func handleRead(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		switch onMissing {
+		case MISSING_EMPTY:
+			output()
+		case MISSING_SILENT:
+		default:
+			return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+		}
+		return nil
+	}
+	countRead(args[0])
+	output(value)
+	return nil
+}
+
+// handleReadDefault prints the value of a key or, if it is unset, the rest of
+// the line, so that a default can span several words.
+func handleReadDefault(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		value = strings.Join(args[1:], " ")
+	} else {
+		countRead(args[0])
+	}
+	output(value)
+	return nil
+}
+
+func handleRender(t *transaction, args []string) error {
+	strict := len(args) > 1
+	if strict && strings.ToUpper(args[1]) != STRICT {
+		return errorf(ERR_PARSE, "Error: unknown option: %s", args[1])
+	}
+	rendered, err := render(t.store, []string{args[0]}, strict)
+	if err != nil {
+		return err
+	}
+	output(rendered)
+	return nil
+}
+
+// handleHistory prints the values kept by -history that a key had before its
+// latest committed change, newest first. Deletions are left out. Without a
+// key it prints the last commands run, oldest first, with their sequence
+// numbers.
+func handleHistory(t *transaction, args []string) error {
+	if len(args) == 0 {
+		if noHistory {
+			return errorf(ERR_CONFIG, "Error: command history is disabled by -no-history")
+		}
+		for _, c := range commandHistory {
+			output(c.seq, c.line)
+		}
+		return nil
+	}
+	if historySize <= 0 {
+		return errorf(ERR_CONFIG, "Error: key history is disabled, enable it with -history")
+	}
+	changes := keyHistory[args[0]]
+	for i := len(changes) - 2; i >= 0; i-- {
+		if !changes[i].deleted {
+			output(changes[i].value)
+		}
+	}
+	return nil
+}
+
+func handleWrite(t *transaction, args []string) error {
+	var value string
+	if len(args) > 1 {
+		value = args[1]
+	}
+	report := len(args) > 2
+	if report && strings.ToUpper(args[2]) != REPORT {
+		return errorf(ERR_PARSE, "Error: unknown option: %s", args[2])
+	}
+
+	var path string
+	var aborted bool
+	var err error
+	switch {
+	case strings.HasPrefix(value, HEREDOC) && len(value) > len(HEREDOC):
+		value, aborted, err = readHeredoc(value[len(HEREDOC):])
+	case strings.HasPrefix(value, FROM_FILE) && len(value) > len(FROM_FILE):
+		path = value[len(FROM_FILE):]
+		value, err = readValueFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	if aborted {
+		output("Aborted: value discarded")
+		return nil
+	}
+	if asciiOnly {
+		if err := checkASCII(value); err != nil {
+			return err
+		}
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	_, existed := t.store[args[0]]
+	t.store[args[0]] = value
+	if path != "" {
+		// Record the file rather than its contents, which may be secret.
+		recordChange(keyChange{key: args[0], value: value})
+		recordMutation(WRITE, args[0], FROM_FILE+path)
+	} else {
+		recordWrite(args[0], value)
+	}
+
+	if report {
+		if existed {
+			output("updated")
+		} else {
+			output("created")
+		}
+	}
+	return nil
+}
+
+func handleWriteB64(t *transaction, args []string) error {
+	value, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return errorf(ERR_PARSE, "Error: invalid base64: %s", args[1])
+	}
+	if asciiOnly {
+		if err := checkASCII(string(value)); err != nil {
+			return err
+		}
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+	t.store[args[0]] = string(value)
+	recordWrite(args[0], string(value))
+	return nil
+}
+
+func handleWriteIfChanged(t *transaction, args []string) error {
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+	if value, ok := t.store[args[0]]; ok && value == args[1] {
+		output(0)
+		return nil
+	}
+	t.store[args[0]] = args[1]
+	recordWrite(args[0], args[1])
+	output(1)
+	return nil
+}
+
+func handleReadB64(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	countRead(args[0])
+	output(base64.StdEncoding.EncodeToString([]byte(value)))
+	return nil
+}
+
+// handleChecksum prints the SHA-256 digest of the value of a key in hex.
+func handleChecksum(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	countRead(args[0])
+	output(checksum(value))
+	return nil
+}
+
+// handleVerify prints 1 if the SHA-256 digest of the value of a key is the
+// given hex digest, in either case, and 0 otherwise.
+func handleVerify(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	want, err := hex.DecodeString(args[1])
+	if err != nil || len(want) != sha256.Size {
+		return errorf(ERR_PARSE, "Error: invalid SHA-256 digest: %s", args[1])
+	}
+	countRead(args[0])
+	if hex.EncodeToString(want) == checksum(value) {
+		output(1)
+	} else {
+		output(0)
+	}
+	return nil
+}
+
+// checksum returns the SHA-256 digest of value in lower-case hex.
+func checksum(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyMeta is the JSON object printed by READMETA. Values are typed as in a
+// DUMPJSON file. Only Key and Found are set for an unset key.
+type keyMeta struct {
+	Key    string  `json:"key"`
+	Found  bool    `json:"found"`
+	Value  *string `json:"value,omitempty"`
+	Type   string  `json:"type,omitempty"`
+	Locked *bool   `json:"locked,omitempty"`
+}
+
+func handleReadMeta(t *transaction, args []string) error {
+	meta := keyMeta{Key: args[0]}
+	if value, ok := t.store[args[0]]; ok {
+		countRead(args[0])
+		locked := lockedKeys[args[0]]
+		meta.Found, meta.Type, meta.Locked = true, TYPE_STRING, &locked
+		if !utf8.ValidString(value) {
+			value, meta.Type = base64.StdEncoding.EncodeToString([]byte(value)), TYPE_BYTES
+		}
+		meta.Value = &value
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return errorf(ERR_FORMAT, "Error: encoding %s: %s", args[0], err)
+	}
+	output(string(data))
+	return nil
+}
+
+// handleHotKeys prints the most read keys with their read counts, most read
+// first and in sorted order among equal counts.
+func handleHotKeys(t *transaction, args []string) error {
+	if !countAccess {
+		return errorf(ERR_CONFIG, "Error: access counting is disabled, enable it with -count-access")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return errorf(ERR_PARSE, "Error: invalid count: %s", args[0])
+	}
+
+	keys := make([]string, 0, len(accessCounts))
+	for k := range accessCounts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if accessCounts[keys[i]] != accessCounts[keys[j]] {
+			return accessCounts[keys[i]] > accessCounts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	for _, k := range keys {
+		output(k, accessCounts[k])
+	}
+	return nil
+}
+
+// countRead counts a read of key while -count-access is set.
+func countRead(key string) {
+	if countAccess {
+		accessCounts[key]++
+	}
+}
+
+// handleInsert reads "key value" lines up to INSERT_END and then stores every
+// pair. Malformed lines are reported and skipped; INSERT_ABORT or the end of
+// input discards the pairs read so far.
+func handleInsert(t *transaction, args []string) error {
+	var keys, values []string
+	for {
+		line, ok := scanInput()
+		if !ok {
+			return errorf(ERR_PARSE, "Error: end of input before %s, %d pairs discarded", INSERT_END, len(keys))
+		}
+		words := strings.Fields(line)
+		switch {
+		case len(words) == 1 && words[0] == INSERT_END:
+			if err := checkUnlocked(keys...); err != nil {
+				return errorf(errorCode(err), "%s, %d pairs discarded", err, len(keys))
+			}
+			for i, k := range keys {
+				t.store[k] = values[i]
+				recordWrite(k, values[i])
+			}
+			outputf("Inserted: %d pairs\n", len(keys))
+			return nil
+		case len(words) == 1 && strings.ToUpper(words[0]) == INSERT_ABORT:
+			outputf("Aborted: %d pairs discarded\n", len(keys))
+			return nil
+		case len(words) != 2:
+			logError(errorf(ERR_PARSE, "Error: expected <key> <value>, got: %s", line))
+			continue
+		}
+		if asciiOnly {
+			if err := checkASCII(line); err != nil {
+				logError(err)
+				continue
+			}
+		}
+		keys, values = append(keys, words[0]), append(values, words[1])
+	}
+}
+
+// readHeredoc reads lines of input up to one equal to end and returns them
+// joined by newlines. If a line is HEREDOC_ABORT first, nothing is returned
+// but aborted; if the input ends first, nothing is returned but an error.
+func readHeredoc(end string) (value string, aborted bool, err error) {
+	var lines []string
+	for {
+		line, ok := scanInput()
+		if !ok {
+			return "", false, errorf(ERR_PARSE, "Error: end of input before %s, value discarded", end)
+		}
+		switch {
+		case line == end:
+			return strings.Join(lines, "\n"), false, nil
+		case strings.EqualFold(line, HEREDOC_ABORT):
+			return "", true, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// inputEnd returns, for the command name run with args, a function telling
+// whether a line ends the input the command reads after its own line: the
+// terminator of a WRITE here-doc, or the line ending or aborting an INSERT.
+// It returns nil if the command reads no further input.
+func inputEnd(name string, args []string) func(line string) bool {
+	switch {
+	case name == WRITE && len(args) > 1 && strings.HasPrefix(args[1], HEREDOC) && len(args[1]) > len(HEREDOC):
+		end := args[1][len(HEREDOC):]
+		return func(line string) bool { return line == end || strings.EqualFold(line, HEREDOC_ABORT) }
+	case name == INSERT:
+		return func(line string) bool {
+			words := strings.Fields(line)
+			return len(words) == 1 && (words[0] == INSERT_END || strings.ToUpper(words[0]) == INSERT_ABORT)
+		}
+	}
+	return nil
+}
+
+// readInput reads, up to and including the line ending it, the input the
+// command name would read after its own line when run with args, so that it
+// can be queued with the command.
+func readInput(name string, args []string) ([]string, error) {
+	end := inputEnd(name, args)
+	if end == nil {
+		return nil, nil
+	}
+	var lines []string
+	for {
+		line, ok := scanInput()
+		if !ok {
+			return nil, errorf(ERR_PARSE, "Error: end of input inside the input of %s", name)
+		}
+		lines = append(lines, line)
+		if end(line) {
+			return lines, nil
+		}
+	}
+}
+
+// readValueFile returns the contents of the file at path without its
+// trailing newline, if any.
+func readValueFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errorf(ERR_IO, "Error: reading %s: %s", path, err)
+	}
+	value := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(value, "\r"), nil
+}
+
+func handleDelete(t *transaction, args []string) error {
+	if _, ok := t.store[args[0]]; !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+	delete(t.store, args[0])
+	recordDelete(args[0])
+	return nil
+}
+
+// handleDelIf deletes a key if its value is expected, printing 1, or else
+// leaves it, printing 0.
+func handleDelIf(t *transaction, args []string) error {
+	if value, ok := t.store[args[0]]; !ok || value != args[1] {
+		output(0)
+		return nil
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+	delete(t.store, args[0])
+	recordDelete(args[0])
+	output(1)
+	return nil
+}
+
+// handleSnapKey saves the value of a key, or that it is unset, for
+// RESTOREKEY.
+func handleSnapKey(t *transaction, args []string) error {
+	var snapshot *string
+	if value, ok := t.store[args[0]]; ok {
+		snapshot = &value
+	}
+	keySnapshots[args[0]] = snapshot
+	return nil
+}
+
+// handleRestoreKey gives a key back the value saved by its last SNAPKEY, or
+// deletes it if it was unset then. The snapshot is kept, so it can be
+// restored again.
+func handleRestoreKey(t *transaction, args []string) error {
+	snapshot, ok := keySnapshots[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Error: no snapshot of key: %s", args[0])
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	if snapshot == nil {
+		if _, ok := t.store[args[0]]; ok {
+			delete(t.store, args[0])
+			recordDelete(args[0])
+		}
+		return nil
+	}
+	t.store[args[0]] = *snapshot
+	recordWrite(args[0], *snapshot)
+	return nil
+}
+
+func handleRenameNX(t *transaction, args []string) error {
+	old, renamed := args[0], args[1]
+	value, ok := t.store[old]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", old)
+	}
+	if _, ok := t.store[renamed]; ok {
+		output(0)
+		return nil
+	}
+	if err := checkUnlocked(old, renamed); err != nil {
+		return err
+	}
+
+	t.store[renamed] = value
+	delete(t.store, old)
+	recordWrite(renamed, value)
+	recordDelete(old)
+	output(1)
+	return nil
+}
+
+// handleSwap exchanges the values of two keys, which must both exist.
+func handleSwap(t *transaction, args []string) error {
+	first, second := args[0], args[1]
+	firstValue, ok := t.store[first]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", first)
+	}
+	secondValue, ok := t.store[second]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", second)
+	}
+	if err := checkUnlocked(first, second); err != nil {
+		return err
+	}
+
+	t.store[first], t.store[second] = secondValue, firstValue
+	recordWrite(first, secondValue)
+	recordWrite(second, firstValue)
+	return nil
+}
+
+// handleLink writes the current value of src to dst. The copy is made once:
+// later changes to src do not change dst.
+func handleLink(t *transaction, args []string) error {
+	dst, src := args[0], args[1]
+	value, ok := t.store[src]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", src)
+	}
+	if err := checkUnlocked(dst); err != nil {
+		return err
+	}
+	countRead(src)
+
+	t.store[dst] = value
+	recordWrite(dst, value)
+	return nil
+}
+
+// handleFlushAll deletes every key. Without CONFIRM it asks for confirmation
+// when input is read from a terminal, and fails otherwise, as it does when
+// other commands follow on the same line and could be taken for the answer.
+func handleFlushAll(t *transaction, args []string) error {
+	if len(args) > 0 {
+		if strings.ToUpper(args[0]) != CONFIRM {
+			return errorf(ERR_PARSE, "Error: unknown option: %s", args[0])
+		}
+	} else if !interactive() || len(chainedLines) > 0 {
+		return errorf(ERR_PARSE, "Error: FLUSHALL deletes every key, use FLUSHALL %s to proceed", CONFIRM)
+	} else {
+		outputf("Are you sure? (y/N) ")
+		answer, _ := scanLine()
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			output("Not flushed")
+			return nil
+		}
+	}
+
+	flushed := make(map[string]string)
+	if err := checkUnlockedDiff(t.store, flushed); err != nil {
+		return err
+	}
+	recordDiff(t.store, flushed)
+	t.store = flushed
+	return nil
+}
+
+// handleRenamePrefix renames every key starting with the old prefix. If a new
+// name is taken by a key that is not renamed nothing is renamed.
+func handleRenamePrefix(t *transaction, args []string) error {
+	old, renamed := args[0], args[1]
+	var keys []string
+	for _, k := range sortedKeys(t.store) {
+		if strings.HasPrefix(k, old) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		target := renamed + strings.TrimPrefix(k, old)
+		if _, ok := t.store[target]; ok && !strings.HasPrefix(target, old) {
+			return errorf(ERR_CONFLICT, "Error: renaming %s would overwrite %s", k, target)
+		}
+		if err := checkUnlocked(k, target); err != nil {
+			return err
+		}
+	}
+
+	values := make(map[string]string, len(keys))
+	for _, k := range keys {
+		values[renamed+strings.TrimPrefix(k, old)] = t.store[k]
+		delete(t.store, k)
+		recordDelete(k)
+	}
+	for _, k := range sortedKeys(values) {
+		t.store[k] = values[k]
+		recordWrite(k, values[k])
+	}
+	output(len(keys))
+	return nil
+}
+
+// handleLock locks an existing key. Locks are not part of transactions: they
+// take effect at once and are kept whether the transaction is committed or
+// aborted.
+func handleLock(t *transaction, args []string) error {
+	if _, ok := t.store[args[0]]; !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	lockedKeys[args[0]] = true
+	return nil
+}
+
+func handleUnlock(t *transaction, args []string) error {
+	if !lockedKeys[args[0]] {
+		return errorf(ERR_NOT_FOUND, "Error: key is not locked: %s", args[0])
+	}
+	delete(lockedKeys, args[0])
+	return nil
+}
+
+// checkUnlocked returns an error naming the first of keys that is locked.
+func checkUnlocked(keys ...string) error {
+	for _, k := range keys {
+		if lockedKeys[k] {
+			return errorf(ERR_LOCKED, "Error: key is locked: %s", k)
+		}
+	}
+	return nil
+}
+
+// checkUnlockedDiff returns an error naming the first locked key, in sorted
+// order, that replacing the store from by to would change.
+func checkUnlockedDiff(from, to map[string]string) error {
+	keys := make([]string, 0, len(lockedKeys))
+	for k := range lockedKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		old, had := from[k]
+		value, has := to[k]
+		if had != has || old != value {
+			return errorf(ERR_LOCKED, "Error: key is locked: %s", k)
+		}
+	}
+	return nil
+}
+
+func handleTrim(t *transaction, args []string) error {
+	return transform(t, args[0], strings.TrimSpace)
+}
+
+func handleUpper(t *transaction, args []string) error {
+	return transform(t, args[0], strings.ToUpper)
+}
+
+func handleLower(t *transaction, args []string) error {
+	return transform(t, args[0], strings.ToLower)
+}
+
+// transform replaces the value of key in t by the result of applying fn to it
+// and prints the new value.
+func transform(t *transaction, key string, fn func(string) string) error {
+	value, ok := t.store[key]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", key)
+	}
+	if err := checkUnlocked(key); err != nil {
+		return err
+	}
+	value = fn(value)
+	t.store[key] = value
+	recordWrite(key, value)
+	output(value)
+	return nil
+}
+
+// valueTransforms maps the operations of MAPVALUES to the functions of the
+// commands of the same name.
+var valueTransforms = map[string]func(string) string{
+	TRIM:  strings.TrimSpace,
+	UPPER: strings.ToUpper,
+	LOWER: strings.ToLower,
+}
+
+// handleMapValues transforms the values of the keys matching a glob pattern,
+// with the syntax of SCAN patterns. If one of the keys that would change is
+// locked nothing is changed.
+func handleMapValues(t *transaction, args []string) error {
+	pattern := args[0]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errorf(ERR_PARSE, "Error: invalid pattern: %s", pattern)
+	}
+	fn, ok := valueTransforms[strings.ToUpper(args[1])]
+	if !ok {
+		return errorf(ERR_PARSE, "Error: unknown operation: %s", args[1])
+	}
+
+	changed := make(map[string]string)
+	var keys []string
+	for _, k := range sortedKeys(t.store) {
+		if ok, _ := path.Match(pattern, k); ok {
+			if value := fn(t.store[k]); value != t.store[k] {
+				changed[k] = value
+				keys = append(keys, k)
+			}
+		}
+	}
+	if err := checkUnlocked(keys...); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		t.store[k] = changed[k]
+		recordWrite(k, changed[k])
+	}
+	output(len(keys))
+	return nil
+}
+
+func handleTruncate(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	length, err := strconv.Atoi(args[1])
+	if err != nil || length < 0 {
+		return errorf(ERR_PARSE, "Error: invalid length: %s", args[1])
+	}
+
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	runes := []rune(value)
+	if length >= len(runes) {
+		return nil
+	}
+	value = string(runes[:length])
+	t.store[args[0]] = value
+	recordWrite(args[0], value)
+	return nil
+}
+
+// handlePipe replaces the value of a key with the output, without its
+// trailing newline, of a program given the value as its input. The program
+// and its arguments are run as given, without a shell.
+func handlePipe(t *transaction, args []string) error {
+	if !allowExec {
+		return errorf(ERR_CONFIG, "Error: running programs is disabled, enable it with -allow-exec")
+	}
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PIPE_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[1], args[2:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(value + "\n")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errorf(ERR_TIMEOUT, "Timed out after %s running: %s", PIPE_TIMEOUT, args[1])
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return errorf(ERR_IO, "Error: running %s: %s", args[1], err)
+	}
+
+	value = strings.TrimSuffix(stdout.String(), "\n")
+	if asciiOnly {
+		if err := checkASCII(value); err != nil {
+			return err
+		}
+	}
+	t.store[args[0]] = value
+	recordWrite(args[0], value)
+	return nil
+}
+
+// handleNextID adds n to the integer value of a key, 0 if it is unset, and
+// prints the value before, the first of the n IDs reserved.
+func handleNextID(t *transaction, args []string) error {
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || n < 1 {
+		return errorf(ERR_PARSE, "Error: invalid count: %s", args[1])
+	}
+	var first int64
+	if value, ok := t.store[args[0]]; ok {
+		if first, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return errorf(ERR_FORMAT, "Error: value of %s is not an integer: %s", args[0], value)
+		}
+	}
+	if first > math.MaxInt64-n {
+		return errorf(ERR_ARITHMETIC, "Error: reserving %d IDs from %d overflows", n, first)
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	value := strconv.FormatInt(first+n, 10)
+	t.store[args[0]] = value
+	recordWrite(args[0], value)
+	output(first)
+	return nil
+}
+
+// handleDecrBy subtracts a signed amount from the integer value of a key, 0
+// if it is unset, and prints the result. A result out of the range of a
+// 64-bit integer is an error, and the value is left unchanged.
+func handleDecrBy(t *transaction, args []string) error {
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorf(ERR_PARSE, "Error: invalid amount: %s", args[1])
+	}
+	var current int64
+	if value, ok := t.store[args[0]]; ok {
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return errorf(ERR_FORMAT, "Error: value of %s is not an integer: %s", args[0], value)
+		}
+	}
+	if (amount > 0 && current < math.MinInt64+amount) || (amount < 0 && current > math.MaxInt64+amount) {
+		return errorf(ERR_ARITHMETIC, "Error: subtracting %d from %d overflows", amount, current)
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	value := strconv.FormatInt(current-amount, 10)
+	t.store[args[0]] = value
+	recordWrite(args[0], value)
+	output(value)
+	return nil
+}
+
+func handleEval(t *transaction, args []string) error {
+	if args[1] != "=" {
+		return errorf(ERR_PARSE, "Error: expected = after %s, usage: %s <key> = <expr>", args[0], EVAL)
+	}
+	result, err := eval(t.store, strings.Join(args[2:], " "))
+	if err != nil {
+		return err
+	}
+	if err := checkUnlocked(args[0]); err != nil {
+		return err
+	}
+
+	value := strconv.FormatInt(result, 10)
+	t.store[args[0]] = value
+	recordWrite(args[0], value)
+	return nil
+}
+
+func handleSubstr(t *transaction, args []string) error {
+	return substr(t.store, args[0], args[1], args[2])
+}
+
+func handleGrep(t *transaction, args []string) error {
+	switch {
+	case len(args) == 1:
+		grep(t.store, args[0], false)
+	case args[0] == "-i":
+		grep(t.store, args[1], true)
+	default:
+		return errorf(ERR_PARSE, "Error: unknown option: %s", args[0])
+	}
+	return nil
+}
+
+func handleMatch(t *transaction, args []string) error {
+	return match(t.store, args[0])
+}
+
+// optionalArg returns args[0], or the empty string if there are no args.
+func optionalArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
+
+// handleKeysLine prints every key, sorted, on a single line joined by the
+// separator, a space by default. The separator cannot hold BATCH_SEPARATOR,
+// since the line is split into commands there before KEYSLINE sees it:
+// KEYSLINE ; is KEYSLINE with no separator.
+func handleKeysLine(t *transaction, args []string) error {
+	separator := " "
+	if len(args) > 0 {
+		separator = args[0]
+	}
+	output(strings.Join(sortedKeys(t.store), separator))
+	return nil
+}
+
+func handleReadPrefix(t *transaction, args []string) error {
+	prefix := optionalArg(args)
+	var keys []string
+	for _, k := range sortedKeys(t.store) {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	outputPairs(t.store, keys)
+	return nil
+}
+
+// handleSortByValue prints every key and value sorted by value, and by key
+// among equal values. With NUMERIC, values that are not numbers sort as zero
+// or, with STRICT, are an error.
+func handleSortByValue(t *transaction, args []string) error {
+	var numeric, desc, strict bool
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case NUMERIC:
+			numeric = true
+		case DESC:
+			desc = true
+		case STRICT:
+			strict = true
+		default:
+			return errorf(ERR_PARSE, "Error: unknown option: %s", arg)
+		}
+	}
+
+	keys := sortedKeys(t.store)
+	numbers := make(map[string]float64)
+	if numeric {
+		for _, k := range keys {
+			n, err := strconv.ParseFloat(t.store[k], 64)
+			if err != nil && strict {
+				return errorf(ERR_FORMAT, "Error: value of %s is not a number: %s", k, t.store[k])
+			}
+			numbers[k] = n
+		}
+	}
+	less := func(a, b string) bool {
+		if numeric {
+			return numbers[a] < numbers[b]
+		}
+		return t.store[a] < t.store[b]
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if desc {
+			return less(keys[j], keys[i])
+		}
+		return less(keys[i], keys[j])
+	})
+	outputPairs(t.store, keys)
+	return nil
+}
+
+func handleKeyAt(t *transaction, args []string) error {
+	i, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errorf(ERR_PARSE, "Error: invalid index: %s", args[0])
+	}
+	keys := sortedKeys(t.store)
+	if i < 0 {
+		i += len(keys)
+	}
+	if i < 0 || i >= len(keys) {
+		return errorf(ERR_NOT_FOUND, "Error: index out of range: %s (%d keys)", args[0], len(keys))
+	}
+	output(keys[i])
+	return nil
+}
+
+func handleCountPrefix(t *transaction, args []string) error {
+	prefix := optionalArg(args)
+	n := 0
+	for k := range t.store {
+		if strings.HasPrefix(k, prefix) {
+			n++
+		}
+	}
+	output(n)
+	return nil
+}
+
+// handleRangeSum prints the total, count, minimum and maximum of the integer
+// values of the keys starting with a prefix, as "name: value" lines, and the
+// number of values skipped for not being integers. The minimum and maximum
+// are left out if there are no integers. With STRICT a value that is not an
+// integer is an error instead.
+func handleRangeSum(t *transaction, args []string) error {
+	strict := len(args) > 1
+	if strict && strings.ToUpper(args[1]) != STRICT {
+		return errorf(ERR_PARSE, "Error: unknown option: %s", args[1])
+	}
+
+	var total, min, max int64
+	count, skipped := 0, 0
+	for _, k := range sortedKeys(t.store) {
+		if !strings.HasPrefix(k, args[0]) {
+			continue
+		}
+		n, err := strconv.ParseInt(t.store[k], 10, 64)
+		if err != nil {
+			err = errorf(ERR_FORMAT, "Error: value of %s is not an integer: %s", k, t.store[k])
+			if strict {
+				return err
+			}
+			logError(err)
+			skipped++
+			continue
+		}
+		if (n > 0 && total > math.MaxInt64-n) || (n < 0 && total < math.MinInt64-n) {
+			return errorf(ERR_ARITHMETIC, "Error: sum of values starting with %s overflows", args[0])
+		}
+		total += n
+		if count == 0 || n < min {
+			min = n
+		}
+		if count == 0 || n > max {
+			max = n
+		}
+		count++
+	}
+
+	outputf("total: %d\n", total)
+	outputf("count: %d\n", count)
+	if count > 0 {
+		outputf("min: %d\n", min)
+		outputf("max: %d\n", max)
+	}
+	outputf("skipped: %d\n", skipped)
+	return nil
+}
+
+// handleScan parses either SCAN <cursor> <count> or
+// SCAN <cursor> [MATCH <pattern>] [COUNT <count>].
+func handleScan(t *transaction, args []string) error {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return errorf(ERR_PARSE, "Error: invalid cursor: %s", args[0])
+	}
+
+	count, pattern := strconv.Itoa(DEFAULT_SCAN_COUNT), ""
+	options := args[1:]
+	if len(options) == 1 {
+		count = options[0]
+		options = nil
+	}
+	if len(options)%2 != 0 {
+		return errorf(ERR_PARSE, "Error: missing value of option: %s", options[len(options)-1])
+	}
+	for i := 0; i < len(options); i += 2 {
+		switch strings.ToUpper(options[i]) {
+		case MATCH:
+			pattern = options[i+1]
+		case COUNT:
+			count = options[i+1]
+		default:
+			return errorf(ERR_PARSE, "Error: unknown option: %s", options[i])
+		}
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return errorf(ERR_PARSE, "Error: invalid count: %s", count)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errorf(ERR_PARSE, "Error: invalid pattern: %s", pattern)
+	}
+
+	scan(t.store, cursor, n, pattern, false)
+	return nil
+}
+
+// handleScanValues prints the next cursor and the next count keys with their
+// values, as SCAN <cursor> COUNT <count> prints the keys.
+func handleScanValues(t *transaction, args []string) error {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return errorf(ERR_PARSE, "Error: invalid cursor: %s", args[0])
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return errorf(ERR_PARSE, "Error: invalid count: %s", args[1])
+	}
+	scan(t.store, cursor, n, "", true)
+	return nil
+}
+
+func handleAssert(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	switch {
+	case !ok:
+		failedAssertions++
+		return errorf(ERR_ASSERT, "Assertion failed: key not found: %s", args[0])
+	case value != args[1]:
+		failedAssertions++
+		return errorf(ERR_ASSERT, "Assertion failed: %s is %s, expected %s", args[0], value, args[1])
+	}
+	return nil
+}
+
+// handleRequire fails, like a failed ASSERT, unless every key is set, naming
+// those that are not.
+func handleRequire(t *transaction, args []string) error {
+	var missing []string
+	for _, k := range args {
+		if _, ok := t.store[k]; !ok && !containsString(missing, k) {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		failedAssertions++
+		return errorf(ERR_ASSERT, "Assertion failed: keys not found: %s", strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// handleWaitFor prints the value of a key once it is set. Commands come from a
+// single input, so nothing can set the key while waiting for it: WAITFOR
+// checks the key once and, if it is unset, fails immediately, with the code
+// of a timeout, instead of sleeping for it.
+func handleWaitFor(t *transaction, args []string) error {
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds < 0 {
+		return errorf(ERR_PARSE, "Error: invalid timeout: %s", args[1])
+	}
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_TIMEOUT, "Key not set: %s; %s does not wait for the %ds timeout when commands are read from a single input", args[0], WAITFOR, seconds)
+	}
+	output(value)
+	return nil
+}
+
+// handleWaitSize prints the number of keys once there are at least n. Like
+// WAITFOR, it checks once and, if there are fewer, fails immediately with the
+// number reached instead of sleeping for it.
+func handleWaitSize(t *transaction, args []string) error {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return errorf(ERR_PARSE, "Error: invalid size: %s", args[0])
+	}
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds < 0 {
+		return errorf(ERR_PARSE, "Error: invalid timeout: %s", args[1])
+	}
+	if len(t.store) < n {
+		return errorf(ERR_TIMEOUT, "%d keys, fewer than %d; %s does not wait for the %ds timeout when commands are read from a single input", len(t.store), n, WAITSIZE, seconds)
+	}
+	output(len(t.store))
+	return nil
+}
+
+func handleStart(t *transaction, args []string) error {
+	if t.depth >= maxDepth {
+		return errorf(ERR_TXN, "Error: maximum transaction depth of %d reached (current depth %d)", maxDepth, t.depth)
+	}
+
+	child := t.begin()
+	beginRecords()
+	child.run()
+	endRecords(child.committed)
+	// If transaction was not aborted...
+	if child.committed {
+		// Synchronize the contents of the store with those of the
+		// transaction.
+		t.store = child.store
+	}
+	if child.unwind > 0 {
+		// COMMIT or ABORT of several levels: end t the same way.
+		t.done, t.committed, t.unwind = true, child.committed, child.unwind-1
+	}
+	return nil
+}
+
+// handleCommit commits t or, given a number of levels n, t and the n-1
+// transactions enclosing it, into the transaction that encloses them all.
+func handleCommit(t *transaction, args []string) error {
+	if t.parent == nil {
+		return errNotInTransaction
+	}
+	levels, ifChanged := 1, false
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		switch {
+		case strings.ToUpper(arg) == IFCHANGED:
+			ifChanged = true
+		case err != nil:
+			return errorf(ERR_PARSE, "Error: unknown option: %s", arg)
+		case n < 1 || n > t.depth:
+			return errorf(ERR_TXN, "Error: cannot commit %d levels at depth %d", n, t.depth)
+		default:
+			levels = n
+		}
+	}
+
+	target := t.parent
+	for i := 1; i < levels; i++ {
+		target = target.parent
+	}
+	added, modified, deleted := diffStores(target.store, t.store)
+	t.done, t.unwind = true, levels-1
+	if ifChanged && len(added)+len(modified)+len(deleted) == 0 {
+		output("Aborted: no changes to commit")
+		return nil
+	}
+	outputf("Committed: %d added, %d modified, %d deleted\n", len(added), len(modified), len(deleted))
+	t.committed = true
+	return nil
+}
+
+func handleAbort(t *transaction, args []string) error {
+	if t.parent == nil {
+		return errNotInTransaction
+	}
+	added, modified, deleted := diffStores(t.parent.store, t.store)
+	outputf("Aborted: %d pending changes discarded\n", len(added)+len(modified)+len(deleted))
+	t.done = true
+	return nil
+}
+
+// handleTxnDump prints, sorted by key within each group, the keys and new
+// values added and modified by t, then the keys it deleted.
+func handleTxnDump(t *transaction, args []string) error {
+	if t.parent == nil {
+		return errNotInTransaction
+	}
+	printDiff(t.parent.store, t.store)
+	return nil
+}
+
+// handleTxnDiff prints, in the format of TXNDUMP, how the store the
+// transaction would commit differs from the one saved by DUMPJSON to a file.
+func handleTxnDiff(t *transaction, args []string) error {
+	if t.parent == nil {
+		return errNotInTransaction
+	}
+	saved, err := loadJSON(args[0])
+	if err != nil {
+		return err
+	}
+	printDiff(saved, t.store)
+	return nil
+}
+
+// handleExportTxn writes to a file the DELETE and WRITE commands that make
+// the changes of the transaction, between START and COMMIT, so that
+// replaying the file makes them atomically.
+func handleExportTxn(t *transaction, args []string) error {
+	if t.parent == nil {
+		return errNotInTransaction
+	}
+	added, modified, deleted := diffStores(t.parent.store, t.store)
+	lines := []string{START}
+	for _, k := range deleted {
+		lines = append(lines, DELETE+" "+k)
+	}
+	for _, k := range append(added, modified...) {
+		lines = append(lines, writeCommand(k, t.store[k]))
+	}
+	lines = append(lines, COMMIT)
+	if err := os.WriteFile(args[0], []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return errorf(ERR_IO, "Error: writing %s: %s", args[0], err)
+	}
+	outputf("Exported: %d mutations\n", len(lines)-2)
+	return nil
+}
+
+// printDiff prints the keys added to, modified in, and deleted from the
+// store from to give the store to, as "+ key value", "~ key value" and
+// "- key" lines.
+func printDiff(from, to map[string]string) {
+	added, modified, deleted := diffStores(from, to)
+	for _, k := range added {
+		output("+", k, to[k])
+	}
+	for _, k := range modified {
+		output("~", k, to[k])
+	}
+	for _, k := range deleted {
+		output("-", k)
+	}
+}
+
+// handleWhere prints the depth of the outermost transaction from which the
+// value of a key is unchanged in the current one, followed by "committed" at
+// depth 0 outside transactions, "pending" if the value was written by the
+// current transaction, and "inherited" otherwise.
+func handleWhere(t *transaction, args []string) error {
+	value, ok := t.store[args[0]]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", args[0])
+	}
+	origin := t
+	for origin.parent != nil {
+		if v, ok := origin.parent.store[args[0]]; !ok || v != value {
+			break
+		}
+		origin = origin.parent
+	}
+
+	switch {
+	case t.parent == nil:
+		outputf("%d committed\n", origin.depth)
+	case origin == t:
+		outputf("%d pending\n", origin.depth)
+	default:
+		outputf("%d inherited\n", origin.depth)
+	}
+	return nil
+}
+
+// handleTrace prints, from the current transaction outwards, a line for
+// each level down to the one that gave a key its current value or removed
+// it: "<depth> written <value>" or "<depth> deleted" if the level changed the
+// key, "<depth> inherited" or "<depth> absent" if it left it as in the level
+// below, and "0 committed <value>" or "0 absent" outside transactions.
+func handleTrace(t *transaction, args []string) error {
+	for level := t; level != nil; level = level.parent {
+		value, ok := level.store[args[0]]
+		if level.parent == nil {
+			if ok {
+				outputf("%d committed %s\n", level.depth, value)
+			} else {
+				outputf("%d absent\n", level.depth)
+			}
+			break
+		}
+
+		parentValue, parentOK := level.parent.store[args[0]]
+		switch {
+		case ok && (!parentOK || parentValue != value):
+			outputf("%d written %s\n", level.depth, value)
+			return nil
+		case !ok && parentOK:
+			outputf("%d deleted\n", level.depth)
+			return nil
+		case ok:
+			outputf("%d inherited\n", level.depth)
+		default:
+			outputf("%d absent\n", level.depth)
+		}
+	}
+	return nil
+}
+
+// queuedCommand is a command parsed from line and waiting to be run by
+// TRANSACTION or EXEC.
+type queuedCommand struct {
+	line    string
+	command command
+	args    []string
+	// input holds the lines read by the command after its own, such as a
+	// here-doc, read when it was queued.
+	input []string
+}
+
+// handleTransaction runs the BATCH_SEPARATOR separated commands in args
+// with runQueued, unless one of them cannot be parsed. Empty commands, as
+// after a trailing separator, are skipped.
+func handleTransaction(t *transaction, args []string) error {
+	var queue []queuedCommand
+	for _, segment := range strings.Split(strings.Join(args, " "), BATCH_SEPARATOR) {
+		words := strings.Fields(segment)
+		if len(words) == 0 {
+			continue
+		}
+		c, cmdArgs, err := preProcessInput(words)
+		if err == nil && c.control {
+			err = errorf(ERR_TXN, "Command not allowed in %s: %s", TRANSACTION, c.name)
+		}
+		if err != nil {
+			return errorf(errorCode(err), "Error: %s rolled back at command %d (%s): %s",
+				TRANSACTION, len(queue)+1, strings.TrimSpace(segment), err)
+		}
+		queue = append(queue, queuedCommand{strings.TrimSpace(segment), c, cmdArgs, nil})
+	}
+	return runQueued(t, TRANSACTION, queue)
+}
+
+// runQueued runs queue in a transaction nested in t, which is committed if
+// every command succeeds. Otherwise an error naming the first failing command
+// and the command name that ran the queue, with the code of the command's
+// error, is returned and t is left untouched.
+func runQueued(t *transaction, name string, queue []queuedCommand) error {
+	child := t.begin()
+	beginRecords()
+	for i, q := range queue {
+		queuedInput = q.input
+		err := q.command.handler(child, q.args)
+		queuedInput = nil
+		if err != nil {
+			endRecords(false)
+			return errorf(errorCode(err), "Error: %s rolled back at command %d (%s): %s", name, i+1, q.line, err)
+		}
+	}
+	endRecords(true)
+
+	t.store = child.store
+	return nil
+}
+
+func handleMulti(t *transaction, args []string) error {
+	t.queuing, t.queue, t.queueFailed = true, nil, false
+	return nil
+}
+
+// enqueue queues the command c parsed from line, or the error parsing it,
+// until EXEC or DISCARD.
+func (t *transaction) enqueue(line string, c command, args []string, err error) error {
+	if err == nil && c.control {
+		err = errorf(ERR_TXN, "Command not allowed in %s: %s", MULTI, c.name)
+	}
+	var input []string
+	if err == nil {
+		input, err = readInput(c.name, args)
+	}
+	if err != nil {
+		t.queueFailed = true
+		return err
+	}
+	t.queue = append(t.queue, queuedCommand{strings.TrimSpace(line), c, args, input})
+	output("QUEUED")
+	return nil
+}
+
+// handleExec runs the commands queued since MULTI with runQueued. If any of
+// them could not be queued none is run.
+func handleExec(t *transaction, args []string) error {
+	if !t.queuing {
+		return errorf(ERR_TXN, "Error: %s without %s", EXEC, MULTI)
+	}
+	queue, failed := t.queue, t.queueFailed
+	t.queuing, t.queue, t.queueFailed = false, nil, false
+	if failed {
+		return errorf(ERR_TXN, "Error: %s discarded, a queued command had errors", EXEC)
+	}
+	return runQueued(t, EXEC, queue)
+}
+
+func handleDiscard(t *transaction, args []string) error {
+	if !t.queuing {
+		return errorf(ERR_TXN, "Error: %s without %s", DISCARD, MULTI)
+	}
+	t.queuing, t.queue, t.queueFailed = false, nil, false
+	return nil
+}
+
+// dump is the JSON document written by DUMPJSON.
+type dump struct {
+	Version int         `json:"version"`
+	Entries []dumpEntry `json:"entries"`
+}
+
+// dumpEntry is a key of a dump with the type of its value. The value is kept
+// raw so that types other than strings can be added without changing the
+// format.
+type dumpEntry struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func handleDumpJSON(t *transaction, args []string) error {
+	return writeDump(args[0], t.store, sortedKeys(t.store))
+}
+
+// handleSaveMatch writes the keys matching a glob pattern, with the syntax of
+// SCAN patterns, to a file in the format of DUMPJSON and prints how many.
+func handleSaveMatch(t *transaction, args []string) error {
+	pattern := args[0]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errorf(ERR_PARSE, "Error: invalid pattern: %s", pattern)
+	}
+	var keys []string
+	for _, k := range sortedKeys(t.store) {
+		if ok, _ := path.Match(pattern, k); ok {
+			keys = append(keys, k)
+		}
+	}
+	if err := writeDump(args[1], t.store, keys); err != nil {
+		return err
+	}
+	output(len(keys))
+	return nil
+}
+
+// handleExportSorted writes a key=value line for each key, in sorted order.
+// Keys and values are escaped like Go string literals without the quotes,
+// and a = in a key is written as \x3d, so that each entry is one line that
+// changes only when the entry does.
+func handleExportSorted(t *transaction, args []string) error {
+	var b strings.Builder
+	keys := sortedKeys(t.store)
+	for _, k := range keys {
+		key := strings.Replace(escape(k), "=", `\x3d`, -1)
+		fmt.Fprintf(&b, "%s=%s\n", key, escape(t.store[k]))
+	}
+	if err := os.WriteFile(args[0], []byte(b.String()), 0644); err != nil {
+		return errorf(ERR_IO, "Error: writing %s: %s", args[0], err)
+	}
+	output(len(keys))
+	return nil
+}
+
+// handleExportGo writes to a file the declaration of a Go variable holding
+// the store as a map[string]string literal, sorted by key, and prints the
+// number of keys.
+func handleExportGo(t *transaction, args []string) error {
+	name, path := args[0], args[1]
+	if !token.IsIdentifier(name) {
+		return errorf(ERR_PARSE, "Error: invalid Go identifier: %s", name)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "var %s = map[string]string{\n", name)
+	keys := sortedKeys(t.store)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\t%s: %s,\n", strconv.Quote(k), strconv.Quote(t.store[k]))
+	}
+	b.WriteString("}\n")
+
+	src, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return errorf(ERR_INTERNAL, "Error: formatting %s: %s", path, err)
+	}
+	if err := os.WriteFile(path, src, 0644); err != nil {
+		return errorf(ERR_IO, "Error: writing %s: %s", path, err)
+	}
+	output(len(keys))
+	return nil
+}
+
+// escape returns s quoted as a Go string literal, without the quotes.
+func escape(s string) string {
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// writeDump writes keys of kvStore, in order, to the file at path in the
+// format of DUMPJSON.
+func writeDump(path string, kvStore map[string]string, keys []string) error {
+	d := dump{Version: DUMP_VERSION, Entries: []dumpEntry{}}
+	for _, k := range keys {
+		typ, v := TYPE_STRING, kvStore[k]
+		if !utf8.ValidString(v) {
+			typ, v = TYPE_BYTES, base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return errorf(ERR_FORMAT, "Error: encoding %s: %s", k, err)
+		}
+		d.Entries = append(d.Entries, dumpEntry{Key: k, Type: typ, Value: value})
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errorf(ERR_FORMAT, "Error: encoding dump: %s", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return errorf(ERR_IO, "Error: writing %s: %s", path, err)
+	}
+	return nil
+}
+
+func handleLoadJSON(t *transaction, args []string) error {
+	loaded, err := loadJSON(args[0])
+	if err != nil {
+		return err
+	}
+	if asciiOnly {
+		if err := checkASCIIStore(loaded); err != nil {
+			return err
+		}
+	}
+	if err := checkUnlockedDiff(t.store, loaded); err != nil {
+		return err
+	}
+	recordDiff(t.store, loaded)
+	t.store = loaded
+	return nil
+}
+
+func handleDryLoad(t *transaction, args []string) error {
+	loaded, err := loadJSON(args[0])
+	if err != nil {
+		return err
+	}
+	added, modified, deleted := diffStores(t.store, loaded)
+	outputf("Would load %d keys: %d added, %d modified, %d deleted\n", len(loaded), len(added), len(modified), len(deleted))
+	return nil
+}
+
+func handleReplay(t *transaction, args []string) error {
+	replayed, applied, err := replay(args[0], t.store)
+	if err != nil {
+		return err
+	}
+	if asciiOnly {
+		if err := checkASCIIStore(replayed); err != nil {
+			return err
+		}
+	}
+	if err := checkUnlockedDiff(t.store, replayed); err != nil {
+		return err
+	}
+	recordDiff(t.store, replayed)
+	t.store = replayed
+	outputf("Replayed: %d mutations\n", applied)
+	return nil
+}
+
+// replay applies the WRITE, WRITEB64 and DELETE commands in a file written by RECORD
+// to a copy of kvStore, returning the copy and the number of commands
+// applied. A WRITE from a file reads the file again, as it would on stdin. A
+// here-doc cut short, as by a crash while recording, ends the replay without
+// its WRITE; any other line that RECORD would not write is an error, and
+// nothing is applied.
+func replay(path string, kvStore map[string]string) (map[string]string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errorf(ERR_IO, "Error: opening %s: %s", path, err)
+	}
+	defer f.Close()
+
+	replayed := make(map[string]string, len(kvStore))
+	for k, v := range kvStore {
+		replayed[k] = v
+	}
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, maxLineBytes)
+	applied, lineNo := 0, 0
+	for s.Scan() {
+		lineNo++
+		words := strings.Fields(s.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		cmd := resolveCommand(words[0])
+		switch {
+		case cmd == DELETE && len(words) == 2:
+			delete(replayed, words[1])
+		case cmd == WRITE && len(words) == 3 && strings.HasPrefix(words[2], HEREDOC):
+			end := strings.TrimPrefix(words[2], HEREDOC)
+			var lines []string
+			closed, aborted := false, false
+			for !closed && s.Scan() {
+				lineNo++
+				aborted = s.Text() != end && strings.EqualFold(s.Text(), HEREDOC_ABORT)
+				if closed = s.Text() == end || aborted; !closed {
+					lines = append(lines, s.Text())
+				}
+			}
+			if !closed {
+				if err := s.Err(); err != nil {
+					return nil, 0, errorf(ERR_IO, "Error: reading %s: %s", path, err)
+				}
+				logError(errorf(ERR_FORMAT, "Error: %s ends before %s, last WRITE discarded", path, end))
+				return replayed, applied, nil
+			}
+			if aborted {
+				continue
+			}
+			replayed[words[1]] = strings.Join(lines, "\n")
+		case cmd == WRITE && len(words) == 3 && strings.HasPrefix(words[2], FROM_FILE) && len(words[2]) > len(FROM_FILE):
+			value, err := readValueFile(words[2][len(FROM_FILE):])
+			if err != nil {
+				return nil, 0, errorf(errorCode(err), "Error: %s:%d: %s", path, lineNo, strings.TrimPrefix(err.Error(), "Error: "))
+			}
+			replayed[words[1]] = value
+		case cmd == WRITE && len(words) == 3:
+			replayed[words[1]] = words[2]
+		case cmd == WRITEB64 && len(words) == 3:
+			value, err := base64.StdEncoding.DecodeString(words[2])
+			if err != nil {
+				return nil, 0, errorf(ERR_FORMAT, "Error: %s:%d: invalid base64: %s", path, lineNo, words[2])
+			}
+			replayed[words[1]] = string(value)
+		default:
+			return nil, 0, errorf(ERR_FORMAT, "Error: %s:%d: not a recorded WRITE, WRITEB64 or DELETE", path, lineNo)
+		}
+		applied++
+	}
+	if err := s.Err(); err != nil {
+		return nil, 0, errorf(ERR_IO, "Error: reading %s: %s", path, err)
+	}
+	return replayed, applied, nil
+}
+
+// loadJSON reads a file written by DUMPJSON into a new store.
+func loadJSON(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errorf(ERR_IO, "Error: reading %s: %s", path, err)
+	}
+	var d dump
+	if err := json.Unmarshal(data, &d); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, errorf(ERR_FORMAT, "Error: parsing %s: line %d: %s", path, lineAt(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return nil, errorf(ERR_FORMAT, "Error: parsing %s: line %d: %s", path, lineAt(data, typeErr.Offset), err)
+		}
+		return nil, errorf(ERR_FORMAT, "Error: parsing %s: %s", path, err)
+	}
+	if d.Version != DUMP_VERSION {
+		return nil, errorf(ERR_FORMAT, "Error: unsupported dump version %d in %s", d.Version, path)
+	}
+
+	kvStore := make(map[string]string)
+	for _, e := range d.Entries {
+		if e.Type != TYPE_STRING && e.Type != TYPE_BYTES {
+			return nil, errorf(ERR_FORMAT, "Error: unknown type %q of key %s in %s", e.Type, e.Key, path)
+		}
+		var value string
+		err := json.Unmarshal(e.Value, &value)
+		if err == nil && e.Type == TYPE_BYTES {
+			var decoded []byte
+			decoded, err = base64.StdEncoding.DecodeString(value)
+			value = string(decoded)
+		}
+		if err != nil {
+			return nil, errorf(ERR_FORMAT, "Error: invalid value of key %s in %s: %s", e.Key, path, err)
+		}
+		kvStore[e.Key] = value
+	}
+	return kvStore, nil
+}
+
+// lineAt returns the number of the line of data holding the byte at offset.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func handleRecord(t *transaction, args []string) error {
+	if t.parent != nil {
+		return errorf(ERR_TXN, "Error: %s cannot be used inside a transaction", RECORD)
+	}
+	if strings.ToUpper(args[0]) == STOP {
+		stopRecording()
+		return nil
+	}
+	return startRecording(args[0])
+}
+
+func handleCompact(t *transaction, args []string) error {
+	if t.parent != nil {
+		return errorf(ERR_TXN, "Error: %s cannot be used inside a transaction", COMPACT)
+	}
+	if recording == nil {
+		return errorf(ERR_CONFIG, "Error: not recording, start with %s <file>", RECORD)
+	}
+	before, after, err := compactRecording(t.store)
+	if err != nil {
+		return err
+	}
+	outputf("Compacted: %d bytes to %d bytes\n", before, after)
+	return nil
+}
+
+// handleCheck replays the recording into an empty store and prints the number
+// of keys on which it differs from the store, with the first CHECK_EXAMPLES
+// of them. The recording only matches a store that was empty when recording
+// started or when it was last compacted.
+func handleCheck(t *transaction, args []string) error {
+	if t.parent != nil {
+		return errorf(ERR_TXN, "Error: %s cannot be used inside a transaction", CHECK)
+	}
+	if recording == nil {
+		return errorf(ERR_CONFIG, "Error: not recording, start with %s <file>", RECORD)
+	}
+	replayed, _, err := replay(recording.Name(), make(map[string]string))
+	if err != nil {
+		return err
+	}
+
+	added, modified, deleted := diffStores(t.store, replayed)
+	var mismatches []string
+	for _, k := range deleted {
+		mismatches = append(mismatches, fmt.Sprintf("- %s %s", k, t.store[k]))
+	}
+	for _, k := range added {
+		mismatches = append(mismatches, fmt.Sprintf("+ %s %s", k, replayed[k]))
+	}
+	for _, k := range modified {
+		mismatches = append(mismatches, fmt.Sprintf("~ %s %s", k, replayed[k]))
+	}
+	outputf("Mismatches: %d\n", len(mismatches))
+	for i, m := range mismatches {
+		if i == CHECK_EXAMPLES {
+			break
+		}
+		output(m)
+	}
+	return nil
+}
+
+func handlePause(t *transaction, args []string) error {
+	paused = true
+	return nil
+}
+
+func handleResume(t *transaction, args []string) error {
+	paused = false
+	return nil
+}
+
+func handleEchoMode(t *transaction, args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case ON:
+		echo = true
+	case OFF:
+		echo = false
+	default:
+		return errorf(ERR_PARSE, "Error: unknown setting: %s", args[0])
+	}
+	return nil
+}
+
+func handleOnMissing(t *transaction, args []string) error {
+	switch setting := strings.ToUpper(args[0]); setting {
+	case MISSING_ERROR, MISSING_EMPTY, MISSING_SILENT:
+		onMissing = setting
+		return nil
+	}
+	return errorf(ERR_PARSE, "Error: unknown setting: %s", args[0])
+}
+
+// liveSettings lists the flags that RECONFIG may change.
+var liveSettings = map[string]bool{
+	"alias":      true,
+	"ascii-only": true,
+	"max-depth":  true,
+	"quiet":      true,
+	"time":       true,
+}
+
+func handleReconfig(t *transaction, args []string) error {
+	name := strings.TrimLeft(args[0], "-")
+	f := flag.Lookup(name)
+	if f == nil {
+		return errorf(ERR_CONFIG, "Error: unknown setting: %s", args[0])
+	}
+	if !liveSettings[name] {
+		return errorf(ERR_CONFIG, "Error: setting cannot be changed at runtime: %s", name)
+	}
+	if err := f.Value.Set(args[1]); err != nil {
+		return errorf(ERR_CONFIG, "Error: invalid value %q for %s: %s", args[1], name, err)
+	}
+	return nil
+}
+
+func handleMemUsage(t *transaction, args []string) error {
+	output(memUsage(t.store))
+	return nil
+}
+
+// handleInfo prints a "name: value" line for each figure of the summary.
+// There is a single database, and mutations are persisted only by RECORD.
+func handleInfo(t *transaction, args []string) error {
+	outputf("keys: %d\n", len(t.store))
+	outputf("databases: %d\n", 1)
+	outputf("depth: %d\n", t.depth)
+	outputf("started: %s\n", started.Format(time.RFC3339))
+	outputf("uptime: %s\n", time.Since(started).Round(time.Second))
+	outputf("commands_processed: %d\n", commandsProcessed)
+	outputf("recording: %t\n", recording != nil)
+	return nil
+}
+
+func handleUptime(t *transaction, args []string) error {
+	outputf("started: %s\n", started.Format(time.RFC3339))
+	outputf("uptime: %s\n", time.Since(started).Round(time.Second))
+	return nil
+}
+
+func handleMark(t *transaction, args []string) error {
+	markedKeys = len(t.store)
+	return nil
+}
+
+// handleDelta prints the change in the number of keys since MARK, signed, as
+// in +3 or -1.
+func handleDelta(t *transaction, args []string) error {
+	if markedKeys < 0 {
+		return errorf(ERR_CONFIG, "Error: no mark, set one with %s", MARK)
+	}
+	outputf("%+d\n", len(t.store)-markedKeys)
+	return nil
+}
+
+// metrics is the JSON object printed by METRICS JSON.
+type metrics struct {
+	UptimeSeconds     int64          `json:"uptime_seconds"`
+	Keys              int            `json:"keys"`
+	MemoryBytes       int            `json:"memory_bytes"`
+	Depth             int            `json:"depth"`
+	CommandsProcessed int            `json:"commands_processed"`
+	Commands          map[string]int `json:"commands"`
+}
+
+func handleMetrics(t *transaction, args []string) error {
+	if strings.ToUpper(args[0]) != JSON {
+		return errorf(ERR_PARSE, "Error: unknown format: %s", args[0])
+	}
+	data, err := json.Marshal(metrics{
+		UptimeSeconds:     int64(time.Since(started) / time.Second),
+		Keys:              len(t.store),
+		MemoryBytes:       memUsage(t.store),
+		Depth:             t.depth,
+		CommandsProcessed: commandsProcessed,
+		Commands:          commandCounts,
+	})
+	if err != nil {
+		return errorf(ERR_FORMAT, "Error: encoding metrics: %s", err)
+	}
+	output(string(data))
+	return nil
+}
+
+// handleLimits prints a "name: value" line for each limit. A key must fit on
+// a line of input, as must a value unless it is given as a here-doc or read
+// from a file; nothing limits the number of keys.
+func handleLimits(t *transaction, args []string) error {
+	outputf("max_key_bytes: %d\n", maxLineBytes)
+	output("max_value_bytes: unlimited")
+	output("max_keys: unlimited")
+	outputf("max_depth: %d\n", maxDepth)
+	return nil
+}
+
+func handleConsistency(t *transaction, args []string) error {
+	output(GUARANTEE)
+	return nil
+}
+
+// handleCommand prints, sorted by name, each command with its minimum and
+// maximum number of arguments and its description, separated by tabs.
+func handleCommand(t *transaction, args []string) error {
+	names := make([]string, 0, len(commandIndex))
+	for name := range commandIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commandIndex[name]
+		outputf("%s\t%d\t%d\t%s\n", c.name, c.minArgs, c.maxArgs, c.description)
+	}
+	return nil
+}
+
+// handleDisabled prints, sorted by name, each command that the current
+// settings reject, with the reason, separated by a tab.
+func handleDisabled(t *transaction, args []string) error {
+	names := make([]string, 0, len(commandIndex))
+	for name := range commandIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reason := disabledReason(commandIndex[name]); reason != "" {
+			outputf("%s\t%s\n", name, reason)
+		}
+	}
+	return nil
+}
+
+// disabledReason returns why the current settings reject c, or "" if they
+// do not.
+func disabledReason(c command) string {
+	switch {
+	case readOnly && c.mutating && !c.replicates:
+		return "changes the store, which is read-only"
+	case paused && c.mutating:
+		return "changes the store, and writes are paused until " + RESUME
+	case c.name == PIPE && !allowExec:
+		return "needs -allow-exec"
+	case c.name == HOTKEYS && !countAccess:
+		return "needs -count-access"
+	}
+	return ""
+}
+
+func handleQuit(t *transaction, args []string) error {
+	output("Exiting...")
+	shutdown(0)
+	return nil
+}
+
+// sortedKeys returns the keys of kvStore in lexical order.
+func sortedKeys(kvStore map[string]string) []string {
+	keys := make([]string, 0, len(kvStore))
+	for k := range kvStore {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scan prints the cursor to pass to the next SCAN followed by the keys among
+// the count keys starting at position cursor of the sorted key list that
+// match the glob pattern, or all of them if pattern is empty, each followed by
+// its value if withValues is set. A returned cursor of 0 means the iteration
+// is complete. Patterns have the syntax of path.Match, so * does not match
+// a /.
+// Keys written or deleted between calls shift the positions of the keys
+// sorted after them, so those keys may be skipped or repeated.
+func scan(kvStore map[string]string, cursor, count int, pattern string, withValues bool) {
+	keys := sortedKeys(kvStore)
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	// Compare against what is left rather than adding, so that a count near
+	// the largest int does not overflow.
+	end, next := len(keys), 0
+	if count < len(keys)-cursor {
+		end = cursor + count
+		next = end
+	}
+
+	output(next)
+	for _, k := range keys[cursor:end] {
+		if ok, _ := path.Match(pattern, k); !ok && pattern != "" {
+			continue
+		}
+		if withValues {
+			output(k, kvStore[k])
+		} else {
+			output(k)
+		}
+	}
+}
+
+// substr prints the runes of the value of key from start (inclusive) to end
+// (exclusive). Negative indices count back from the end of the value, as in
+// Python slices, and indices outside the value are clamped to its bounds.
+func substr(kvStore map[string]string, key, start, end string) error {
+	value, ok := kvStore[key]
+	if !ok {
+		return errorf(ERR_NOT_FOUND, "Key not found: %s", key)
+	}
+	runes := []rune(value)
+
+	from, err := sliceIndex(start, len(runes))
+	if err != nil {
+		return err
+	}
+	to, err := sliceIndex(end, len(runes))
+	if err != nil {
+		return err
+	}
+	if from > to {
+		from = to
+	}
+
+	output(string(runes[from:to]))
+	return nil
+}
+
+// sliceIndex parses index and resolves it against a sequence of length n,
+// counting negative indices from the end and clamping the result to [0, n].
+func sliceIndex(index string, n int) (int, error) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return 0, errorf(ERR_PARSE, "Error: invalid index: %s", index)
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 {
+		i = 0
+	}
+	if i > n {
+		i = n
+	}
+	return i, nil
+}
+
+// grep prints, sorted by key, every key and value of kvStore whose value
+// contains substring. With ignoreCase the match is case-insensitive.
+func grep(kvStore map[string]string, substring string, ignoreCase bool) {
+	if ignoreCase {
+		substring = strings.ToLower(substring)
+	}
+	var keys []string
+	for _, k := range sortedKeys(kvStore) {
+		value := kvStore[k]
+		if ignoreCase {
+			value = strings.ToLower(value)
+		}
+		if strings.Contains(value, substring) {
+			keys = append(keys, k)
+		}
+	}
+	outputPairs(kvStore, keys)
+}
+
+// match prints, in sorted order, the keys of kvStore whose value matches the
+// regular expression expr.
+func match(kvStore map[string]string, expr string) error {
+	re, ok := patterns[expr]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return errorf(ERR_PARSE, "Error: invalid regular expression: %s", err)
+		}
+		patterns[expr] = re
+	}
+
+	for _, k := range sortedKeys(kvStore) {
+		if re.MatchString(kvStore[k]) {
+			output(k)
+		}
+	}
+	return nil
+}
+
+// render returns the value of the last key of path with each ${key} replaced
+// by the rendered value of key. path holds the keys being rendered, from the
+// key given to RENDER in, so that cyclic references can be reported. A
+// reference to an unset key expands to nothing unless strict is set.
+func render(kvStore map[string]string, path []string, strict bool) (string, error) {
+	key := path[len(path)-1]
+	value, ok := kvStore[key]
+	if !ok {
+		if strict || len(path) == 1 {
+			return "", errorf(ERR_NOT_FOUND, "Key not found: %s", key)
+		}
+		return "", nil
+	}
+	if len(path) > RENDER_MAX_DEPTH {
+		return "", errorf(ERR_FORMAT, "Error: references nested deeper than %d: %s", RENDER_MAX_DEPTH, path[0])
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			break
+		}
+		ref := value[start+2 : start+end]
+		if containsString(path, ref) {
+			return "", errorf(ERR_FORMAT, "Error: cyclic reference: %s -> %s", strings.Join(path, " -> "), ref)
+		}
+		expanded, err := render(kvStore, append(path, ref), strict)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value[:start])
+		b.WriteString(expanded)
+		value = value[start+end+1:]
+	}
+	b.WriteString(value)
+	return b.String(), nil
+}
+
+// evalOperators are the characters that are tokens of their own in an EVAL
+// expression.
+const evalOperators = "+-*/()"
+
+// errOverflow is the error of an EVAL expression whose value, or that of a
+// part of it, is out of the range of a 64-bit integer.
+var errOverflow = errorf(ERR_ARITHMETIC, "Error: integer overflow")
+
+// evaluator evaluates an EVAL expression by recursive descent.
+type evaluator struct {
+	kvStore map[string]string
+	tokens  []string
+	pos     int
+}
+
+// eval returns the value of the integer expression expr, whose operands are
+// literals or keys of kvStore holding integers. A step overflowing a 64-bit
+// integer is an error. The grammar is:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | "(" expr ")" | integer | key
+func eval(kvStore map[string]string, expr string) (int64, error) {
+	e := &evaluator{kvStore: kvStore, tokens: tokenize(expr)}
+	result, err := e.expr()
+	if err != nil {
+		return 0, err
+	}
+	if e.pos < len(e.tokens) {
+		return 0, errorf(ERR_PARSE, "Error: unexpected %s in expression", e.tokens[e.pos])
+	}
+	return result, nil
+}
+
+// tokenize splits expr into operators and the words between them.
+func tokenize(expr string) []string {
+	var tokens []string
+	word := -1
+	for i, r := range expr {
+		if r != ' ' && !strings.ContainsRune(evalOperators, r) {
+			if word < 0 {
+				word = i
+			}
+			continue
+		}
+		if word >= 0 {
+			tokens = append(tokens, expr[word:i])
+			word = -1
+		}
+		if r != ' ' {
+			tokens = append(tokens, string(r))
+		}
+	}
+	if word >= 0 {
+		tokens = append(tokens, expr[word:])
+	}
+	return tokens
+}
+
+// next returns the next token, or "" at the end of the expression.
+func (e *evaluator) next() string {
+	if e.pos >= len(e.tokens) {
+		return ""
+	}
+	return e.tokens[e.pos]
+}
+
+func (e *evaluator) expr() (int64, error) {
+	result, err := e.term()
+	for err == nil && (e.next() == "+" || e.next() == "-") {
+		op := e.next()
+		e.pos++
+		var operand int64
+		if operand, err = e.term(); err != nil {
+			break
+		}
+		if op == "+" {
+			if (operand > 0 && result > math.MaxInt64-operand) || (operand < 0 && result < math.MinInt64-operand) {
+				err = errOverflow
+			}
+			result += operand
+		} else {
+			if (operand < 0 && result > math.MaxInt64+operand) || (operand > 0 && result < math.MinInt64+operand) {
+				err = errOverflow
+			}
+			result -= operand
+		}
+	}
+	return result, err
+}
+
+func (e *evaluator) term() (int64, error) {
+	result, err := e.factor()
+	for err == nil && (e.next() == "*" || e.next() == "/") {
+		op := e.next()
+		e.pos++
+		var operand int64
+		if operand, err = e.factor(); err != nil {
+			break
+		}
+		switch {
+		case op == "*":
+			product := result * operand
+			if result != 0 && (product/result != operand || (result == -1 && operand == math.MinInt64)) {
+				err = errOverflow
+			}
+			result = product
+		case operand == 0:
+			err = errorf(ERR_ARITHMETIC, "Error: division by zero")
+		case result == math.MinInt64 && operand == -1:
+			err = errOverflow
+		default:
+			result /= operand
+		}
+	}
+	return result, err
+}
+
+func (e *evaluator) factor() (int64, error) {
+	token := e.next()
+	e.pos++
+	switch token {
+	case "":
+		return 0, errorf(ERR_PARSE, "Error: unexpected end of expression")
+	case "-":
+		operand, err := e.factor()
+		if err == nil && operand == math.MinInt64 {
+			err = errOverflow
+		}
+		return -operand, err
+	case "(":
+		result, err := e.expr()
+		if err == nil && e.next() != ")" {
+			err = errorf(ERR_PARSE, "Error: missing ) in expression")
+		}
+		e.pos++
+		return result, err
+	case "+", "*", "/", ")":
+		return 0, errorf(ERR_PARSE, "Error: unexpected %s in expression", token)
+	}
+
+	if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return n, nil
+	}
+	value, ok := e.kvStore[token]
+	if !ok {
+		return 0, errorf(ERR_NOT_FOUND, "Key not found: %s", token)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errorf(ERR_FORMAT, "Error: value of %s is not an integer: %s", token, value)
+	}
+	return n, nil
+}
+
+// diffStores returns, in sorted order, the keys of child that are not in
+// parent, the keys whose value differs between them, and the keys of parent
+// that are not in child.
+func diffStores(parent, child map[string]string) (added, modified, deleted []string) {
+	for _, k := range sortedKeys(child) {
+		if value, ok := parent[k]; !ok {
+			added = append(added, k)
+		} else if value != child[k] {
+			modified = append(modified, k)
+		}
+	}
+	for _, k := range sortedKeys(parent) {
+		if _, ok := child[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+	return added, modified, deleted
+}
+
+// startRecording makes RECORD append committed mutations to the file at path.
+func startRecording(path string) error {
+	if recording != nil {
+		return errorf(ERR_IO, "Error: already recording to %s", recording.Name())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errorf(ERR_IO, "Error: cannot record to %s: %s", path, err)
+	}
+	recording = f
+	return nil
+}
+
+// stopRecording closes the file opened by startRecording, if any.
+func stopRecording() {
+	if recording == nil {
+		return
+	}
+	if err := recording.Close(); err != nil {
+		logError(errorf(ERR_IO, "Error: closing %s: %s", recording.Name(), err))
+	}
+	recording = nil
+}
+
+// compactRecording replaces the contents of the recording by a WRITE of each
+// key of kvStore, returning the size of the recording before and after. The
+// new contents are written to a temporary file that is renamed over the
+// recording, so that a failure leaves the recording as it was.
+func compactRecording(kvStore map[string]string) (before, after int64, err error) {
+	path := recording.Name()
+	info, err := recording.Stat()
+	if err != nil {
+		return 0, 0, errorf(ERR_IO, "Error: reading %s: %s", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, 0, errorf(ERR_IO, "Error: compacting %s: %s", path, err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, k := range sortedKeys(kvStore) {
+		fmt.Fprintln(w, writeCommand(k, kvStore[k]))
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, 0, errorf(ERR_IO, "Error: compacting %s: %s", path, err)
+	}
+
+	stopRecording()
+	if err := startRecording(path); err != nil {
+		return 0, 0, err
+	}
+	if info, err := recording.Stat(); err == nil {
+		after = info.Size()
+	}
+	return info.Size(), after, nil
+}
+
+// recordMutation records cmd with its arguments while RECORD is active.
+func recordMutation(cmd string, args ...string) {
+	if recording != nil {
+		record(strings.Join(append([]string{cmd}, args...), " "))
+	}
+}
+
+// recordWrite records a WRITE of value to key.
+func recordWrite(key, value string) {
+	recordChange(keyChange{key: key, value: value})
+	if recording != nil {
+		record(writeCommand(key, value))
+	}
+}
+
+// writeCommand returns a WRITE of value to key, as a here-doc if value is not
+// a single word or would otherwise be taken for a here-doc, a file, a
+// comment, or several commands, or a WRITEB64 if value is not valid UTF-8,
+// holds a carriage return, which would be lost at the end of a line, or has
+// a line that would abort a here-doc.
+func writeCommand(key, value string) string {
+	if !utf8.ValidString(value) || strings.Contains(value, "\r") || heredocAborts(value) {
+		return strings.Join([]string{WRITEB64, key, base64.StdEncoding.EncodeToString([]byte(value))}, " ")
+	}
+	if words := strings.Fields(value); len(words) == 1 && words[0] == value &&
+		!strings.HasPrefix(value, HEREDOC) && !strings.HasPrefix(value, FROM_FILE) && !strings.HasPrefix(value, COMMENT) &&
+		!strings.Contains(value, BATCH_SEPARATOR) {
+		return strings.Join([]string{WRITE, key, value}, " ")
+	}
+
+	end := HEREDOC_END
+	lines := strings.Split(value, "\n")
+	for i := 1; containsString(lines, end); i++ {
+		end = fmt.Sprintf("%s%d", HEREDOC_END, i)
+	}
+	return strings.Join([]string{WRITE, key, HEREDOC + end + "\n" + value + "\n" + end}, " ")
+}
+
+// heredocAborts reports whether a line of value would abort the here-doc
+// writing it.
+func heredocAborts(value string) bool {
+	for _, line := range strings.Split(value, "\n") {
+		if strings.EqualFold(line, HEREDOC_ABORT) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDelete records a DELETE of key.
+func recordDelete(key string) {
+	recordChange(keyChange{key: key, deleted: true})
+	recordMutation(DELETE, key)
+}
+
+// recordDiff records the WRITE and DELETE commands that turn from into to.
+func recordDiff(from, to map[string]string) {
+	added, modified, deleted := diffStores(from, to)
+	for _, k := range deleted {
+		recordDelete(k)
+	}
+	for _, k := range append(added, modified...) {
+		recordWrite(k, to[k])
+	}
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends line to the recording. Inside a transaction the line is
+// held back until the transaction is committed by endRecords.
+func record(line string) {
+	if n := len(pendingRecords); n > 0 {
+		pendingRecords[n-1] = append(pendingRecords[n-1], line)
+		return
+	}
+	if _, err := fmt.Fprintln(recording, line); err != nil {
+		logError(errorf(ERR_IO, "Error: recording to %s: %s", recording.Name(), err))
+	}
+}
+
+// beginRecords opens a level of pending records and changes for a new
+// transaction.
+func beginRecords() {
+	pendingRecords = append(pendingRecords, nil)
+	pendingChanges = append(pendingChanges, nil)
+}
+
+// endRecords closes the innermost level of pending records, passing its
+// mutations and changes on to the enclosing level if the transaction was
+// committed.
+func endRecords(committed bool) {
+	n := len(pendingRecords)
+	lines, changes := pendingRecords[n-1], pendingChanges[n-1]
+	pendingRecords, pendingChanges = pendingRecords[:n-1], pendingChanges[:n-1]
+	if committed {
+		for _, line := range lines {
+			record(line)
+		}
+		for _, c := range changes {
+			recordChange(c)
+		}
+	}
+}
+
+// keyChange is a WRITE or DELETE of a key kept by -history.
+type keyChange struct {
+	key     string
+	value   string
+	deleted bool
+}
+
+// recordChange adds c to the history of its key while -history is set.
+// Inside a transaction the change is held back until it is committed by
+// endRecords.
+func recordChange(c keyChange) {
+	if historySize <= 0 {
+		return
+	}
+	if n := len(pendingChanges); n > 0 {
+		pendingChanges[n-1] = append(pendingChanges[n-1], c)
+		return
+	}
+
+	changes := append(keyHistory[c.key], c)
+	if len(changes) > historySize+1 {
+		changes = append([]keyChange(nil), changes[len(changes)-historySize-1:]...)
+	}
+	keyHistory[c.key] = changes
+}
+
+// memUsage estimates the bytes used by the keys and values of kvStore.
+func memUsage(kvStore map[string]string) int {
+	total := 0
+	for k, v := range kvStore {
+		total += len(k) + len(v) + ENTRY_OVERHEAD
+	}
+	return total
+}
@@ -6,205 +6,1181 @@ A transaction can be commited or aborted.
 
   Implementation
   ---------------
-* All keys and values are ASCII strings delimited by whitespaces. No quoting
-  needed.
-* All keys and values are stored as strings.
-* Errors are output to stderr.
+* All keys and values are UTF-8 strings delimited by whitespaces. No quoting
+  needed. The -ascii-only flag restricts them to ASCII, including values
+  written from here-docs, files and base64, and the stores LOADJSON and
+  REPLAY load.
+* All keys and values are stored as strings. WRITE <key> <<END stores the
+  lines that follow, up to one equal to END, as a multiline value. If input
+  ends before that line, or a line is ABORT, the value is discarded.
+  WRITE <key> @<file> stores the contents of <file>, without a trailing
+  newline. Values starting with << or @ can only be written literally as
+  here-docs. WRITEB64 and READB64 store and print values, which may hold
+  any bytes, base64 encoded.
+* Errors are output to stderr, prefixed by a code that does not depend on
+  the wording of the message (e.g., ERR_NOT_FOUND: Key not found: x).
+* If output cannot be written, e.g. because stdout is a pipe whose reader
+  has exited, the error is reported on stderr and the program exits with
+  code 74.
 * Commands are case-insensitive (i.e., READ == read).
+* An unrecognized command is reported and skipped, unless -strict is given,
+  in which case it makes the program exit with status 1.
+* A word starting with # starts a comment, which runs to the end of the
+  line and is ignored (e.g., WRITE a 1 # counter). A # inside a word, as
+  in a#b, is kept; a value starting with # can be written as a here-doc.
+* Several commands can be given on one line separated by ";". They run one
+  after the other, as if they were on lines of their own, except that the
+  here-doc or INSERT started by one is read from the lines that follow: the
+  commands after it on the line run once it is done. A TRANSACTION takes
+  the rest of its line as its batch.
+* A transaction works on a copy of its parent taken at START: a READ always
+  returns the transaction's own latest WRITE, and changes reach the parent
+  only on COMMIT.
+* Transactions are repeatable-read: the copy is never updated from the
+  parent, so a transaction sees the same parent state for as long as it is
+  open. Since commands are read from a single input, the parent cannot
+  change while a transaction is open anyway.
+* With -read-only the commands that can change the store, such as WRITE,
+  DELETE and LOADJSON, are rejected, except REPLAY, so that a read-only
+  replica can still be fed the recording of its primary. DISABLED lists
+  every command rejected by the current settings, with the reason.
+* PAUSE rejects the same commands, and REPLAY, until RESUME. Transactions
+  open at PAUSE can still be committed or aborted, so the store only changes
+  by their COMMIT while writes are paused.
+* Every flag not given on the command line is read from its environment
+  variable, KV_ followed by the flag name in upper case with dashes replaced
+  by underscores (e.g., KV_MAX_DEPTH). An explicit flag takes precedence over
+  the environment variable, which takes precedence over the default.
+* With -json-rpc every line of input is a request such as
+  {"cmd":"READ","key":"x"}, with "value" and "args" for further arguments.
+  Only the value may be empty or hold whitespace. Each request is answered
+  by one line such as {"ok":true,"output":["1"]} or
+  {"ok":false,"output":[],"code":"ERR_NOT_FOUND","error":"Key not found: x"}.
+  No prompt is printed.
+* RECORD writes committed mutations as commands, so a recording can be
+  replayed by redirecting it to stdin (e.g., kv-cmd < recording), or with
+  REPLAY from within a session.
+* PIPE runs external programs only with -allow-exec, directly rather than
+  through a shell, and kills them after 10 seconds.
+* -validate <file> checks the command names and argument counts of a file
+  of commands, including those run by a TRANSACTION, without running any,
+  printing each invalid line with its number, and exits with status 1 if
+  there is one.
 */
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
 )
 
-var store map[string]string
+// out is where the output of commands is written.
+var out io.Writer = os.Stdout
+
+// scanner reads commands from stdin. It is shared by every transaction level
+// so that input buffered by one level is not lost to the next.
+var scanner = bufio.NewScanner(os.Stdin)
+
+// queuedInput holds the input lines queued with the command that MULTI
+// queued and EXEC is running, read by scanLine before any other input.
+var queuedInput []string
+
+// chainedLines holds the commands that follow, on the same line of input,
+// the command being run.
+var chainedLines []string
+
+// aliases maps alternative command names to the commands they stand for.
+// More can be added with the -alias flag.
+var aliases = aliasFlag{
+	"GET":   READ,
+	"SET":   WRITE,
+	"DEL":   DELETE,
+	"BEGIN": START,
+	"END":   COMMIT,
+}
+
+// patterns caches the regular expressions compiled by MATCH.
+var patterns = make(map[string]*regexp.Regexp)
+
+// asciiOnly rejects arguments containing non-ASCII bytes.
+var asciiOnly bool
+
+// quiet suppresses the non-fatal messages written by log.
+var quiet bool
+
+// strict makes an unrecognized command fatal.
+var strict bool
+
+// paused rejects, like readOnly, the commands that can change the store, and
+// also those that replicate. It is set by PAUSE and cleared by RESUME.
+var paused bool
+
+// onMissing is what READ does with an unset key: one of MISSING_ERROR,
+// MISSING_EMPTY and MISSING_SILENT. It is set by ONMISSING.
+var onMissing = MISSING_ERROR
+
+// validateFile is the file checked by -validate instead of running commands.
+var validateFile string
+
+// table aligns the values printed by READPREFIX, SORTBYVALUE and GREP in a
+// column when stdout is a terminal.
+var table bool
+
+// allowExec lets PIPE run external programs.
+var allowExec bool
+
+// readOnly rejects the commands that can change the store, except those
+// that replicate.
+var readOnly bool
+
+// maxDepth is the maximum number of nested transactions.
+var maxDepth int
+
+// recording is the file RECORD appends committed mutations to, or nil.
+var recording *os.File
+
+// pendingRecords holds, for each open transaction from the outermost in, the
+// mutations recorded in it that have not been committed yet.
+var pendingRecords [][]string
+
+// lockedKeys holds the keys locked by LOCK, which no command may change.
+var lockedKeys = make(map[string]bool)
+
+// countAccess counts the reads of each key in accessCounts.
+var countAccess bool
+
+// accessCounts maps keys to the number of times they were read, while
+// countAccess is set.
+var accessCounts = make(map[string]int)
+
+// historySize is the number of previous changes of each key kept by -history,
+// or 0.
+var historySize int
+
+// keyHistory holds, for each key, its committed changes from the oldest in:
+// the historySize before the current one, and that one.
+var keyHistory = make(map[string][]keyChange)
+
+// keySnapshots holds the value of each key saved by SNAPKEY, or nil if the
+// key was unset. It is not affected by transactions.
+var keySnapshots = make(map[string]*string)
+
+// pendingChanges holds, like pendingRecords, the changes of each open
+// transaction that have not been committed yet, while -history is set.
+var pendingChanges [][]keyChange
+
+// maxLineBytes is the length of the longest line of input accepted.
+var maxLineBytes int
+
+// abortOnError aborts a transaction when one of its commands fails.
+var abortOnError bool
+
+// jsonRPC reads requests and writes responses as JSON instead of text.
+var jsonRPC bool
+
+// timing reports the time taken by each command.
+var timing bool
+
+// echo writes each command to stderr, after ECHO_PREFIX, before running it.
+// It is set by -echo and ECHOMODE.
+var echo bool
+
+// inputWait is the total time spent waiting for input.
+var inputWait time.Duration
+
+// failedAssertions counts the ASSERT and REQUIRE commands that failed.
+var failedAssertions int
+
+// started is when the program started.
+var started = time.Now()
+
+// markedKeys is the number of keys when MARK was last run, or -1 before.
+var markedKeys = -1
+
+// commandsProcessed counts the commands dispatched, including those that
+// failed.
+var commandsProcessed int
+
+// commandCounts counts the commands dispatched by name, leaving out
+// unrecognized ones.
+var commandCounts = make(map[string]int)
+
+// historyEntry is a command kept for HISTORY with its sequence number, the
+// value of commandsProcessed once it was dispatched.
+type historyEntry struct {
+	seq  int
+	line string
+}
+
+// commandHistory holds the last COMMAND_HISTORY_SIZE commands dispatched,
+// unless noHistory is set.
+var commandHistory []historyEntry
+
+// noHistory disables commandHistory.
+var noHistory bool
+
+// shutdownHooks are run, in registration order, before the program exits.
+var shutdownHooks []func()
 
 const (
 	PROMPT = "> "
 
+	// Exit code when output cannot be written (EX_IOERR in sysexits.h).
+	EXIT_IO = 74
+
+	// Codes printed before error messages.
+	ERR_PARSE           = "ERR_PARSE"
+	ERR_UNKNOWN_COMMAND = "ERR_UNKNOWN_COMMAND"
+	ERR_NOT_FOUND       = "ERR_NOT_FOUND"
+	ERR_TXN             = "ERR_TXN"
+	ERR_READ_ONLY       = "ERR_READ_ONLY"
+	ERR_PAUSED          = "ERR_PAUSED"
+	ERR_CONFLICT        = "ERR_CONFLICT"
+	ERR_LOCKED          = "ERR_LOCKED"
+	ERR_ASSERT          = "ERR_ASSERT"
+	ERR_TIMEOUT         = "ERR_TIMEOUT"
+	ERR_CONFIG          = "ERR_CONFIG"
+	ERR_FORMAT          = "ERR_FORMAT"
+	ERR_ARITHMETIC      = "ERR_ARITHMETIC"
+	ERR_IO              = "ERR_IO"
+	ERR_INTERNAL        = "ERR_INTERNAL"
+
 	// Commands.
 	READ   = "READ"   // key
 	WRITE  = "WRITE"  // key value
 	DELETE = "DELETE" // key
+	SCAN   = "SCAN"   // cursor [MATCH pattern] [COUNT count]
+	TRIM   = "TRIM"   // key
+	UPPER  = "UPPER"  // key
+	LOWER  = "LOWER"  // key
+	SUBSTR = "SUBSTR" // key start end
+	GREP   = "GREP"   // [-i] substring
+	MATCH  = "MATCH"  // regex
+	RECORD = "RECORD" // file | STOP
+
+	RENAMENX    = "RENAMENX"    // old new
+	READPREFIX  = "READPREFIX"  // [prefix]
+	COUNTPREFIX = "COUNTPREFIX" // [prefix]
+	KEYSLINE    = "KEYSLINE"    // [separator]
+	RANGESUM    = "RANGESUM"    // prefix [STRICT]
+	TRUNCATE    = "TRUNCATE"    // key length
+	PIPE        = "PIPE"        // key program [arg...]
+	FLUSHALL    = "FLUSHALL"    // [CONFIRM]
+	SWAP        = "SWAP"        // key1 key2
+	READDEFAULT = "READDEFAULT" // key default
+	EVAL        = "EVAL"        // key = expr
+	INSERT      = "INSERT"
+	RENDER      = "RENDER"   // key [STRICT]
+	HISTORY     = "HISTORY"  // key
+	WRITEB64    = "WRITEB64" // key base64
+	READB64     = "READB64"  // key
+	HOTKEYS     = "HOTKEYS"  // n
+	READMETA    = "READMETA" // key
+	KEYAT       = "KEYAT"    // index
+
+	WRITEIFCHANGED = "WRITEIFCHANGED" // key value
+	RENAMEPREFIX   = "RENAMEPREFIX"   // old new
+	LOCK           = "LOCK"           // key
+	UNLOCK         = "UNLOCK"         // key
+	SORTBYVALUE    = "SORTBYVALUE"    // [NUMERIC] [DESC] [STRICT]
+	MAPVALUES      = "MAPVALUES"      // pattern TRIM|UPPER|LOWER
+	LINK           = "LINK"           // dst src
+	DELIF          = "DELIF"          // key expected
+	SNAPKEY        = "SNAPKEY"        // key
+	RESTOREKEY     = "RESTOREKEY"     // key
+	NEXTID         = "NEXTID"         // key n
+	DECRBY         = "DECRBY"         // key amount
+	SCANVALUES     = "SCANVALUES"     // cursor count
+
+	CHECKSUM = "CHECKSUM" // key
+	VERIFY   = "VERIFY"   // key sha256
+
+	WAITFOR = "WAITFOR" // key seconds
+	ASSERT  = "ASSERT"  // key expected
+	REQUIRE = "REQUIRE" // key...
+
+	WAITSIZE = "WAITSIZE" // n seconds
+
+	DUMPJSON = "DUMPJSON" // file
+	LOADJSON = "LOADJSON" // file
+	DRYLOAD  = "DRYLOAD"  // file
+	REPLAY   = "REPLAY"   // file
+
+	SAVEMATCH    = "SAVEMATCH"    // pattern file
+	EXPORTSORTED = "EXPORTSORTED" // file
+	EXPORTGO     = "EXPORTGO"     // name file
+
+	RECONFIG = "RECONFIG" // setting value
+	MEMUSAGE = "MEMUSAGE"
+	COMMAND  = "COMMAND"
+	DISABLED = "DISABLED"
+	INFO     = "INFO"
+	LIMITS   = "LIMITS"
+	METRICS  = "METRICS" // JSON
+	COMPACT  = "COMPACT"
+	CHECK    = "CHECK"
+	PAUSE    = "PAUSE"
+	UPTIME   = "UPTIME"
+	MARK     = "MARK"
+	DELTA    = "DELTA"
+	RESUME   = "RESUME"
+
+	ONMISSING = "ONMISSING" // ERROR|EMPTY|SILENT
+	ECHOMODE  = "ECHOMODE"  // ON|OFF
 
 	QUIT = "QUIT"
 
+	CONSISTENCY = "CONSISTENCY"
+
 	START  = "START"
 	COMMIT = "COMMIT"
 	ABORT  = "ABORT"
 
-	// Usage message for this program.
-	USAGE = `
+	TXNDUMP     = "TXNDUMP"
+	TXNDIFF     = "TXNDIFF"     // file
+	EXPORTTXN   = "EXPORTTXN"   // file
+	WHERE       = "WHERE"       // key
+	TRACE       = "TRACE"       // key
+	TRANSACTION = "TRANSACTION" // cmd; cmd; ...
+	MULTI       = "MULTI"
+	EXEC        = "EXEC"
+	DISCARD     = "DISCARD"
+
+	// Estimated bytes used by each entry of a store besides its key and
+	// value: two string headers plus map bucket bookkeeping.
+	ENTRY_OVERHEAD = 48
+
+	// Options of SCAN, as in SCAN 0 MATCH user:* COUNT 100. MATCH is also a
+	// command.
+	COUNT = "COUNT"
+
+	// Number of keys SCAN examines unless told otherwise.
+	DEFAULT_SCAN_COUNT = 10
+
+	// Option of WRITE that reports whether the key was created or updated.
+	REPORT = "REPORT"
+
+	// Prefix of a WRITE value that reads the value from the following lines,
+	// up to one equal to the rest of the argument.
+	HEREDOC = "<<"
+
+	// Prefix of a WRITE value that reads the value from the file named by
+	// the rest of the argument.
+	FROM_FILE = "@"
+
+	// Terminator used when recording a WRITE of a multiline value.
+	HEREDOC_END = "END"
+
+	// Line of a here-doc, in any case, discarding the value.
+	HEREDOC_ABORT = "ABORT"
+
+	// Format of METRICS.
+	JSON = "JSON"
+
+	// Line ending the pairs read by INSERT, and the line discarding them.
+	INSERT_END   = "."
+	INSERT_ABORT = "ABORT"
+
+	// Option of RENDER that fails on references to unset keys, which
+	// otherwise expand to nothing.
+	STRICT = "STRICT"
+
+	// Options of SORTBYVALUE: compare values as numbers, sort them in
+	// descending order. STRICT makes non-numeric values an error instead of
+	// zero.
+	NUMERIC = "NUMERIC"
+	DESC    = "DESC"
+
+	// Maximum depth of nested references expanded by RENDER.
+	RENDER_MAX_DEPTH = 100
+
+	// Number of commands kept for HISTORY.
+	COMMAND_HISTORY_SIZE = 100
+
+	// Number of mismatching keys CHECK prints.
+	CHECK_EXAMPLES = 5
 
-    Available commands:
-    -------------------
-    READ <key>           Print value of <key>
-    WRITE <key> <value>  Store <value> in <key>
-    DELETE <key>         Delete <key>
+	// Time a program run by PIPE has to finish before it is killed.
+	PIPE_TIMEOUT = 10 * time.Second
 
-    START                Start a transaction
-    COMMIT               Commit transaction
-    ABORT                Abort transaction
+	// Option of FLUSHALL that skips asking for confirmation.
+	CONFIRM = "CONFIRM"
 
-    QUIT                 Exit program
-    `
+	// Option of COMMIT that aborts a transaction that changed nothing.
+	IFCHANGED = "IFCHANGED"
+
+	// Settings of ECHOMODE, and the prefix of the commands it echoes.
+	ON          = "ON"
+	OFF         = "OFF"
+	ECHO_PREFIX = "+ "
+
+	// Settings of ONMISSING: READ of an unset key fails, prints an empty
+	// line, or prints nothing.
+	MISSING_ERROR  = "ERROR"
+	MISSING_EMPTY  = "EMPTY"
+	MISSING_SILENT = "SILENT"
+
+	// Prefix of the environment variables that set flags.
+	ENV_PREFIX = "KV_"
+
+	// Version of the DUMPJSON format.
+	DUMP_VERSION = 1
+
+	// Type of string values in a DUMPJSON file.
+	TYPE_STRING = "string"
+
+	// Type of values that are not valid UTF-8 in a DUMPJSON file, whose
+	// value is base64 encoded.
+	TYPE_BYTES = "bytes"
+
+	// Argument of RECORD that stops recording.
+	STOP = "STOP"
+
+	// Start of a comment, which runs to the end of the line.
+	COMMENT = "#"
+
+	// Separator between the commands chained on a line or in a TRANSACTION
+	// batch.
+	BATCH_SEPARATOR = ";"
+
+	// Consistency guarantee reported by CONSISTENCY.
+	GUARANTEE = `read-your-writes: a READ returns the latest WRITE of the current transaction
+repeatable-read: a transaction sees its parent as it was at START until COMMIT or ABORT`
 )
 
-// exitLog logs the string err message to stderr and exits with error code 1.
-func exitLog(err string) {
-	log(err)
-	os.Exit(1)
+// onShutdown registers hook to be run before the program exits.
+func onShutdown(hook func()) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// shutdown runs the registered shutdown hooks and exits with code, or with
+// code 1 if an ASSERT or REQUIRE failed.
+func shutdown(code int) {
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	if code == 0 && failedAssertions > 0 {
+		fmt.Fprintf(os.Stderr, "%d assertion(s) failed\n", failedAssertions)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// exitLog logs err to stderr, even if quiet is set, and exits with error
+// code 1. A request being answered by -json-rpc is answered with err.
+func exitLog(err error) {
+	fmt.Fprintln(os.Stderr, formatError(err))
+	if responding {
+		respond(err)
+	}
+	shutdown(1)
+}
+
+// output writes its operands to out like fmt.Println. Output that cannot be
+// written, e.g. because stdout is a closed pipe, is fatal.
+func output(a ...interface{}) {
+	if _, err := fmt.Fprintln(out, a...); err != nil {
+		outputFailed(err)
+	}
+}
+
+// outputPairs prints each of keys with its value in kvStore, like output(k,
+// kvStore[k]). With -table and a terminal on stdout the values are aligned,
+// while other output stays one space separated for parsing.
+func outputPairs(kvStore map[string]string, keys []string) {
+	if !table || out != os.Stdout || !terminalOutput() {
+		for _, k := range keys {
+			output(k, kvStore[k])
+		}
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", k, kvStore[k])
+	}
+	if err := w.Flush(); err != nil {
+		outputFailed(err)
+	}
 }
 
-// log logs the string err message to stderr.
+// outputf writes its operands to out like fmt.Printf. Output that cannot be
+// written is fatal.
+func outputf(format string, a ...interface{}) {
+	if _, err := fmt.Fprintf(out, format, a...); err != nil {
+		outputFailed(err)
+	}
+}
+
+// outputFailed reports the write error err and exits with code EXIT_IO.
+func outputFailed(err error) {
+	fmt.Fprintln(os.Stderr, formatError(errorf(ERR_IO, "Error writing output: %s", err)))
+	shutdown(EXIT_IO)
+}
+
+// codedError is an error with one of the ERR_ codes, which is printed before
+// its message so that scripts can tell errors apart without parsing it.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// errorf returns an error with code and the message formatted from format
+// and a.
+func errorf(code, format string, a ...interface{}) error {
+	return &codedError{code, fmt.Sprintf(format, a...)}
+}
+
+// errorCode returns the code of err, or ERR_INTERNAL if it has none.
+func errorCode(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return ERR_INTERNAL
+}
+
+// formatError returns the message of err, without its "Error: " prefix,
+// after its code, as in ERR_NOT_FOUND: Key not found: x.
+func formatError(err error) string {
+	return errorCode(err) + ": " + strings.TrimPrefix(err.Error(), "Error: ")
+}
+
+// logError logs err with its code.
+func logError(err error) {
+	log(formatError(err))
+}
+
+// log logs the string err message to stderr unless quiet is set.
 func log(err string) {
+	if quiet {
+		return
+	}
 	fmt.Fprintln(os.Stderr, err)
 }
 
-// preProcessInput checks that there are more than one but less than three
-// words and returns an error if either of these two conditions are not true
-// else, return each word individually.
-func preProcessInput(words []string) (string, string, string, error) {
-	var cmd, key, value string
+// aliasFlag is a flag.Value that adds NAME=COMMAND pairs to an alias table.
+type aliasFlag map[string]string
+
+func (a aliasFlag) String() string {
+	pairs := make([]string, 0, len(a))
+	for name, cmd := range a {
+		pairs = append(pairs, name+"="+cmd)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
+// Set adds the aliases in value, a comma separated list of NAME=COMMAND.
+// NAME may not be a command, which the alias would hide.
+func (a aliasFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("expected NAME=COMMAND, got %q", pair)
+		}
+		name, target := strings.ToUpper(parts[0]), strings.ToUpper(parts[1])
+		if _, ok := commandIndex[name]; ok {
+			return fmt.Errorf("%q is already a command", parts[0])
+		}
+		if _, ok := commandIndex[target]; !ok {
+			return fmt.Errorf("unknown command %q", parts[1])
+		}
+		a[name] = target
+	}
+	return nil
+}
+
+// resolveCommand upper-cases word and replaces it by the command it is an
+// alias of, if any.
+func resolveCommand(word string) string {
+	cmd := strings.ToUpper(word)
+	if target, ok := aliases[cmd]; ok {
+		return target
+	}
+	return cmd
+}
+
+// preProcessInput checks that words start with a known command and that it
+// is given as many arguments as it accepts and returns an error if either of
+// these two conditions are not true else, return the command and its
+// arguments.
+func preProcessInput(words []string) (command, []string, error) {
 	if len(words) < 1 {
-		return cmd, key, value, fmt.Errorf("Error: expected at least one command: %s", USAGE)
+		return command{}, nil, errorf(ERR_PARSE, "Error: expected at least one command: %s", usage())
 	}
-	if len(words) > 3 {
-		return cmd, key, value, fmt.Errorf("Error: too many arguments: %s", USAGE)
+
+	cmd := resolveCommand(words[0])
+	c, ok := commandIndex[cmd]
+	if !ok {
+		err := errorf(ERR_UNKNOWN_COMMAND, "Unrecognized command: %s", cmd)
+		if strict {
+			exitLog(err)
+		}
+		return command{}, nil, err
 	}
 
-	cmd = strings.ToUpper(words[0])
-	if len(words) > 1 {
-		key = words[1]
+	args := words[1:]
+	if err := checkArgs(c, args); err != nil {
+		return c, nil, err
 	}
-	if len(words) > 2 {
-		value = words[2]
+	if readOnly && c.mutating && !c.replicates {
+		return c, nil, errorf(ERR_READ_ONLY, "Error: %s changes the store, which is read-only", c.name)
+	}
+	if paused && c.mutating {
+		return c, nil, errorf(ERR_PAUSED, "Error: %s changes the store, and writes are paused until %s", c.name, RESUME)
+	}
+	if asciiOnly {
+		for _, arg := range args {
+			if err := checkASCII(arg); err != nil {
+				return c, nil, err
+			}
+		}
 	}
 
-	return cmd, key, value, nil
+	return c, args, nil
 }
 
-func parseTransaction(kvStore map[string]string) map[string]string {
-	tranStore := make(map[string]string)
-	for k, v := range kvStore {
-		tranStore[k] = v
+// checkArgs returns an error if args are too few or too many for c.
+func checkArgs(c command, args []string) error {
+	if c.maxArgs >= 0 && len(args) > c.maxArgs {
+		return errorf(ERR_PARSE, "Error: too many arguments, usage: %s %s", c.name, c.synopsis)
 	}
+	if len(args) < c.minArgs {
+		return errorf(ERR_PARSE, "Error: too few arguments, usage: %s %s", c.name, c.synopsis)
+	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
+// validate prints "path:line: error" for each line of the file at path that
+// names an unknown command or gives it the wrong number of arguments, and
+// returns the number of such lines. The commands of a TRANSACTION are checked
+// too. Nothing is run, and the lines read by a WRITE here-doc or an INSERT
+// are skipped.
+func validate(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errorf(ERR_IO, "Error: opening %s: %s", path, err)
+	}
+	defer f.Close()
 
-	for {
-		fmt.Print(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
-			exitLog(fmt.Sprintf("Error reading standard input: %s", scanner.Err()))
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, maxLineBytes)
+	invalid, lineNo := 0, 0
+	// skipTo tells, for each here-doc or INSERT being skipped in turn,
+	// whether a line ends it.
+	var skipTo []func(line string) bool
+	for s.Scan() {
+		lineNo++
+		line := s.Text()
+		if len(skipTo) > 0 {
+			if skipTo[0](line) {
+				skipTo = skipTo[1:]
+			}
+			continue
 		}
 
-		words := strings.Fields(scanner.Text())
-		cmd, key, value, err := preProcessInput(words)
-		if err != nil {
-			log(err.Error())
+		for _, segment := range splitCommands(stripComment(line)) {
+			ends, err := validateCommand(strings.Fields(segment), false)
+			if err != nil {
+				outputf("%s:%d: %s\n", path, lineNo, formatError(err))
+				invalid++
+				break
+			}
+			skipTo = append(skipTo, ends...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return invalid, errorf(ERR_IO, "Error: reading %s: %s", path, err)
+	}
+	if len(skipTo) > 0 {
+		outputf("%s:%d: %s\n", path, lineNo, formatError(errorf(ERR_PARSE, "Error: end of file inside a here-doc or %s", INSERT)))
+		invalid++
+	}
+	return invalid, nil
+}
+
+// validateCommand checks the command in words as validate does, along with
+// the commands it runs if it is a TRANSACTION, which, like handleTransaction,
+// rejects control commands. It returns the functions ending the input the
+// commands read after their line, in order.
+func validateCommand(words []string, inTransaction bool) ([]func(line string) bool, error) {
+	cmd := resolveCommand(words[0])
+	c, ok := commandIndex[cmd]
+	if !ok {
+		return nil, errorf(ERR_UNKNOWN_COMMAND, "Unrecognized command: %s", cmd)
+	}
+	if err := checkArgs(c, words[1:]); err != nil {
+		return nil, err
+	}
+	if inTransaction && c.control {
+		return nil, errorf(ERR_TXN, "Command not allowed in %s: %s", TRANSACTION, c.name)
+	}
+	if cmd != TRANSACTION {
+		if end := inputEnd(cmd, words[1:]); end != nil {
+			return []func(line string) bool{end}, nil
+		}
+		return nil, nil
+	}
+
+	var ends []func(line string) bool
+	for _, segment := range strings.Split(strings.Join(words[1:], " "), BATCH_SEPARATOR) {
+		subWords := strings.Fields(segment)
+		if len(subWords) == 0 {
 			continue
 		}
+		subEnds, err := validateCommand(subWords, true)
+		if err != nil {
+			return nil, err
+		}
+		ends = append(ends, subEnds...)
+	}
+	return ends, nil
+}
 
-		switch cmd {
-		case READ:
-			if value, ok := tranStore[key]; ok {
-				fmt.Println(value)
-			} else {
-				log(fmt.Sprintf("Key not found: %s", key))
-			}
-		case WRITE:
-			tranStore[key] = value
-		case DELETE:
-			if _, ok := tranStore[key]; ok {
-				delete(tranStore, key)
-			} else {
-				log(fmt.Sprintf("Key not found: %s", key))
-			}
-		case QUIT:
-			fmt.Println("Exiting...")
-			os.Exit(0)
-		case START:
-			transaction := parseTransaction(tranStore)
-			// If transaction was not aborted...
-			if transaction != nil {
-				// Synchronize the contents of the store with those of the
-				// transaction.
-				tranStore = transaction
-			}
-		case COMMIT:
-			return tranStore
-		case ABORT:
-			return nil
-		default:
-			log(fmt.Sprintf("Unrecognized command: %s", cmd))
+// checkASCII returns an error naming the first non-ASCII byte of s.
+func checkASCII(s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return errorf(ERR_PARSE, "Error: non-ASCII byte 0x%02x at position %d of %s", s[i], i+1, s)
 		}
 	}
+	return nil
+}
 
-	return tranStore
+// checkASCIIStore returns the error of checkASCII for the first key, in
+// order, of kvStore that is not ASCII or has a value that is not.
+func checkASCIIStore(kvStore map[string]string) error {
+	for _, k := range sortedKeys(kvStore) {
+		if err := checkASCII(k); err != nil {
+			return err
+		}
+		if err := checkASCII(kvStore[k]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func parentTransaction() {
-	// Initialize empty store.
-	store = make(map[string]string)
+// transaction is one level of nested transactions. The outermost level holds
+// the store itself and has no parent.
+type transaction struct {
+	store  map[string]string
+	parent *transaction
+	depth  int
+
+	// done is set by COMMIT and ABORT to end the transaction, and committed
+	// tells which of the two it was.
+	done      bool
+	committed bool
+
+	// unwind is the number of enclosing transactions that end, the same
+	// way, when this one does, as set by COMMIT <levels>.
+	unwind int
+
+	// queuing is set from MULTI until EXEC or DISCARD, which run or drop the
+	// commands in queue. queueFailed is set if a command could not be queued.
+	queuing     bool
+	queue       []queuedCommand
+	queueFailed bool
+}
+
+// begin returns a transaction nested in t that works on a copy of its store.
+func (t *transaction) begin() *transaction {
+	child := &transaction{
+		store:  make(map[string]string),
+		parent: t,
+		depth:  t.depth + 1,
+	}
+	for k, v := range t.store {
+		child.store[k] = v
+	}
+	return child
+}
+
+// dispatch runs the command in words, read from line, in t, or queues it
+// after MULTI.
+func (t *transaction) dispatch(line string, words []string) error {
+	c, args, err := preProcessInput(words)
+	commandsProcessed++
+	if c.name != "" {
+		commandCounts[c.name]++
+	}
+	if !noHistory {
+		commandHistory = append(commandHistory, historyEntry{commandsProcessed, strings.Join(words, " ")})
+		if len(commandHistory) > COMMAND_HISTORY_SIZE {
+			commandHistory = append([]historyEntry(nil), commandHistory[1:]...)
+		}
+	}
+	if t.queuing && c.name != EXEC && c.name != DISCARD && c.name != QUIT {
+		return t.enqueue(line, c, args, err)
+	}
+	if err != nil {
+		return err
+	}
+	return c.handler(t, args)
+}
+
+// run reads and dispatches commands until t is committed or aborted.
+func (t *transaction) run() {
+	for !t.done {
+		var line string
+		var words []string
+		if jsonRPC {
+			line, words = readRequest()
+		} else {
+			line = readLine()
+			words = strings.Fields(line)
+		}
+		if echo && len(words) > 0 {
+			log(ECHO_PREFIX + strings.TrimSpace(line))
+		}
+		start, waited := time.Now(), inputWait
+		err := t.dispatch(line, words)
+		if err != nil && abortOnError && t.parent != nil && !t.done {
+			err = t.abortAfter(err)
+		}
+		if jsonRPC {
+			respond(err)
+		} else if err != nil {
+			logError(err)
+		}
+		if timing {
+			// Leave out input read by the command itself, such as the
+			// commands of a transaction it starts.
+			log(fmt.Sprintf("Time: %s", time.Since(start)-(inputWait-waited)))
+		}
+	}
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
+// abortAfter aborts t because of err, returning err extended with the
+// abort.
+func (t *transaction) abortAfter(err error) error {
+	added, modified, deleted := diffStores(t.parent.store, t.store)
+	t.done = true
+	return errorf(errorCode(err), "%s; transaction aborted, %d pending changes discarded",
+		err, len(added)+len(modified)+len(deleted))
+}
+
+// readLine returns the next command of input, prompting for a new line once
+// the commands chained on the previous one have been read. At the end of
+// input the program shuts down, successfully unless reading failed. Comments
+// are removed, and lines holding nothing else are skipped.
+func readLine() string {
+	if len(chainedLines) > 0 {
+		line, _ := scanLine()
+		return line
+	}
 
 	for {
-		fmt.Print(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
-			exitLog(fmt.Sprintf("Error reading standard input: %s", scanner.Err()))
+		outputf("%s", PROMPT)
+		line, ok := scanLine()
+		if !ok {
+			shutdown(0)
+		}
+		uncommented := stripComment(line)
+		if strings.TrimSpace(uncommented) != "" || strings.TrimSpace(line) == "" {
+			return chain(uncommented)
+		}
+	}
+}
+
+// stripComment returns line up to the first word starting with COMMENT. A
+// COMMENT inside a word, as in a#b, is kept.
+func stripComment(line string) string {
+	for i := strings.Index(line, COMMENT); i >= 0; {
+		if i == 0 || unicode.IsSpace(rune(line[i-1])) {
+			return line[:i]
+		}
+		next := strings.Index(line[i+1:], COMMENT)
+		if next < 0 {
+			break
 		}
+		i += next + 1
+	}
+	return line
+}
+
+// request is a command read by -json-rpc, e.g. {"cmd":"WRITE","key":"x",
+// "value":"1"}. Its words are the command, the key and value if given, and
+// then args, so that a value may contain whitespace.
+type request struct {
+	Cmd   string   `json:"cmd"`
+	Key   *string  `json:"key"`
+	Value *string  `json:"value"`
+	Args  []string `json:"args"`
+}
+
+// response is the answer to a request written by -json-rpc. Output holds the
+// lines the command printed.
+type response struct {
+	OK     bool     `json:"ok"`
+	Output []string `json:"output"`
+	Code   string   `json:"code,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// responseOutput collects the output of the request being run by -json-rpc,
+// while responding is set.
+var responseOutput bytes.Buffer
+
+// responding is set from reading a request until its response is written.
+var responding bool
 
-		words := strings.Fields(scanner.Text())
-		cmd, key, value, err := preProcessInput(words)
+// readRequest answers the request being run, if any, and returns the next
+// request of input as a line and its words. Malformed requests are answered
+// with an error at once. At the end of input the program shuts down.
+func readRequest() (string, []string) {
+	respond(nil)
+	for {
+		line, ok := scanLine()
+		if !ok {
+			shutdown(0)
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var req request
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			writeResponse(errorf(ERR_PARSE, "Error: invalid request: %s", err))
+			continue
+		}
+		if err := checkRequest(req); err != nil {
+			writeResponse(err)
+			continue
+		}
+		words := []string{req.Cmd}
+		if req.Key != nil {
+			words = append(words, *req.Key)
+		}
+		if req.Value != nil {
+			words = append(words, *req.Value)
+		}
+		words = append(words, req.Args...)
+
+		responseOutput.Reset()
+		out, responding = &responseOutput, true
+		return strings.Join(words, " "), words
+	}
+}
+
+// checkRequest returns an error if a word of req other than its value is
+// empty or holds whitespace, which would shift the words that follow it.
+func checkRequest(req request) error {
+	fields := []string{req.Cmd}
+	names := []string{"cmd"}
+	if req.Key != nil {
+		fields, names = append(fields, *req.Key), append(names, "key")
+	}
+	for _, arg := range req.Args {
+		fields, names = append(fields, arg), append(names, "args")
+	}
+	for i, field := range fields {
+		if field == "" {
+			return errorf(ERR_PARSE, "Error: invalid request: empty %s", names[i])
+		}
+		if strings.IndexFunc(field, unicode.IsSpace) >= 0 {
+			return errorf(ERR_PARSE, "Error: invalid request: whitespace in %s: %q", names[i], field)
+		}
+	}
+	return nil
+}
+
+// respond writes the response to the request being run, with err, if it has
+// not been written yet. A command that reads requests itself, like START,
+// is answered before the first of them is read; an error it returns after
+// that is logged instead.
+func respond(err error) {
+	if !responding {
 		if err != nil {
-			log(err.Error())
+			logError(err)
+		}
+		return
+	}
+	out, responding = os.Stdout, false
+	writeResponse(err)
+}
+
+// writeResponse writes the response holding responseOutput and err.
+func writeResponse(err error) {
+	resp := response{OK: err == nil, Output: []string{}}
+	if text := strings.TrimSuffix(responseOutput.String(), "\n"); text != "" {
+		resp.Output = strings.Split(text, "\n")
+	}
+	responseOutput.Reset()
+	if err != nil {
+		resp.Code, resp.Error = errorCode(err), strings.TrimPrefix(err.Error(), "Error: ")
+	}
+	data, _ := json.Marshal(resp)
+	output(string(data))
+}
+
+// chain splits line into its commands, returning the first one and leaving
+// the others in chainedLines. A line with no commands is returned as is.
+func chain(line string) string {
+	segments := splitCommands(line)
+	if len(segments) == 0 {
+		return line
+	}
+	chainedLines = append(chainedLines, segments[1:]...)
+	return segments[0]
+}
+
+// splitCommands returns the commands of line separated by BATCH_SEPARATOR,
+// without the empty ones. A TRANSACTION takes the rest of the line, with its
+// separators, as its batch.
+func splitCommands(line string) []string {
+	var segments []string
+	parts := strings.Split(line, BATCH_SEPARATOR)
+	for i, segment := range parts {
+		words := strings.Fields(segment)
+		if len(words) == 0 {
 			continue
 		}
+		if resolveCommand(words[0]) == TRANSACTION {
+			return append(segments, strings.Join(parts[i:], BATCH_SEPARATOR))
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
 
-		switch cmd {
-		case READ:
-			if value, ok := store[key]; ok {
-				fmt.Println(value)
-			} else {
-				log(fmt.Sprintf("Key not found: %s", key))
-			}
-		case WRITE:
-			store[key] = value
-		case DELETE:
-			if _, ok := store[key]; ok {
-				delete(store, key)
-			} else {
-				log(fmt.Sprintf("Key not found: %s", key))
-			}
-		case QUIT:
-			fmt.Println("Exiting...")
-			os.Exit(0)
-		case START:
-			transaction := parseTransaction(store)
-			// If transaction was not aborted...
-			if transaction != nil {
-				// Synchronize the contents of the store with those of the
-				// transaction.
-				store = transaction
-			}
-		case COMMIT:
-			log("Error: you are not currently in a transaction")
-		case ABORT:
-			log("Error: you are not currently in a transaction")
-		default:
-			log(fmt.Sprintf("Unrecognized command: %s", cmd))
+// scanLine returns the next line of input, or false at the end of input.
+// Commands left in chainedLines come first. A failure to read input is fatal.
+func scanLine() (string, bool) {
+	if len(queuedInput) == 0 && len(chainedLines) > 0 {
+		line := chainedLines[0]
+		chainedLines = chainedLines[1:]
+		return line, true
+	}
+	return scanInput()
+}
+
+// scanInput returns the next line of the input a command reads after its own
+// line, like a here-doc, as scanLine does but passing over chainedLines: the
+// commands chained to the command are run once it is done.
+func scanInput() (string, bool) {
+	if len(queuedInput) > 0 {
+		line := queuedInput[0]
+		queuedInput = queuedInput[1:]
+		return line, true
+	}
+
+	defer func(start time.Time) {
+		inputWait += time.Since(start)
+	}(time.Now())
+
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err == bufio.ErrTooLong {
+			exitLog(errorf(ERR_PARSE, "Error: input line longer than %d bytes, raise -max-line-bytes", maxLineBytes))
+		}
+		if err != nil {
+			exitLog(errorf(ERR_IO, "Error reading standard input: %s", err))
 		}
+		return "", false
 	}
+	return scanner.Text(), true
+}
+
+// interactive reports whether input is read from a terminal.
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalOutput reports whether stdout is a terminal.
+func terminalOutput() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setFlagsFromEnv sets every flag not given on the command line from its
+// environment variable, if set. The variable of -max-depth is KV_MAX_DEPTH.
+func setFlagsFromEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envVar(f.Name)
+		value, ok := os.LookupEnv(name)
+		if err != nil || given[f.Name] || !ok {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = errorf(ERR_CONFIG, "invalid value %q for %s: %s", value, name, setErr)
+		}
+	})
+	return err
+}
+
+// envVar returns the name of the environment variable of the flag name.
+func envVar(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
 }
 
 func main() {
-	parentTransaction()
+	flag.Var(aliases, "alias", "add a command alias as NAME=COMMAND (repeatable)")
+	flag.IntVar(&maxDepth, "max-depth", 1000, "maximum number of nested transactions")
+	flag.BoolVar(&allowExec, "allow-exec", false, "let PIPE run external programs")
+	flag.BoolVar(&abortOnError, "abort-on-error", false, "abort a transaction when one of its commands fails")
+	flag.BoolVar(&asciiOnly, "ascii-only", false, "reject keys and values that are not ASCII")
+	flag.BoolVar(&echo, "echo", false, "write each command to stderr before running it")
+	flag.BoolVar(&countAccess, "count-access", false, "count the reads of each key for HOTKEYS")
+	flag.IntVar(&historySize, "history", 0, "number of previous changes of each key kept for HISTORY, 0 to keep none")
+	flag.BoolVar(&noHistory, "no-history", false, "do not keep the commands run for HISTORY")
+	flag.BoolVar(&quiet, "quiet", false, "suppress non-fatal messages on stderr")
+	flag.BoolVar(&readOnly, "read-only", false, "reject commands that change the store, except REPLAY")
+	flag.BoolVar(&table, "table", false, "align the keys and values listed on a terminal in columns")
+	flag.BoolVar(&strict, "strict", false, "exit with status 1 on an unrecognized command")
+	flag.BoolVar(&jsonRPC, "json-rpc", false, "read commands as JSON objects, one per line, and answer each with one")
+	flag.BoolVar(&timing, "time", false, "print the time taken by each command on stderr")
+	flag.IntVar(&maxLineBytes, "max-line-bytes", bufio.MaxScanTokenSize, "length of the longest line of input accepted")
+	flag.StringVar(&validateFile, "validate", "", "check the commands in `file` without running them, then exit")
+	flag.Parse()
+	if err := setFlagsFromEnv(); err != nil {
+		exitLog(err)
+	}
+	scanner.Buffer(nil, maxLineBytes)
+
+	if validateFile != "" {
+		invalid, err := validate(validateFile)
+		if err != nil {
+			exitLog(err)
+		}
+		if invalid > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Report writes to a closed pipe as errors instead of being killed.
+	signal.Ignore(syscall.SIGPIPE)
+	onShutdown(func() { respond(nil) })
+	onShutdown(stopRecording)
+
+	// Initialize empty store.
+	root := &transaction{store: make(map[string]string)}
+	root.run()
 }
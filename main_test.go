@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runScript runs the commands of script in root as if read from stdin and
+// returns the lines printed, without prompts, with each error of a command
+// run in root on a line of its own. Errors inside the transactions it starts
+// go to stderr. Every transaction the script starts must end in it.
+func runScript(t *testing.T, root *transaction, script string) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	out, scanner = &buf, bufio.NewScanner(strings.NewReader(script))
+	t.Cleanup(func() {
+		out, scanner = os.Stdout, bufio.NewScanner(os.Stdin)
+	})
+
+	for {
+		line, ok := scanLine()
+		if !ok {
+			break
+		}
+		line = chain(stripComment(line))
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if err := root.dispatch(line, words); err != nil {
+			outputf("%s\n", formatError(err))
+		}
+	}
+
+	text := strings.TrimSuffix(strings.Replace(buf.String(), PROMPT, "", -1), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+func TestMain(m *testing.M) {
+	// Flags are not parsed by tests, so set those the commands rely on.
+	maxDepth = 1000
+	maxLineBytes = bufio.MaxScanTokenSize
+	os.Exit(m.Run())
+}
+
+func newRoot() *transaction {
+	return &transaction{store: make(map[string]string)}
+}
+
+func TestDumpJSONRoundTrip(t *testing.T) {
+	stores := []map[string]string{
+		{},
+		{"a": "1", "b": "two words", "c": ""},
+		{"multi": "line 1\nline 2\n", "tab": "a\tb", "quote": `"q"\`},
+		{"bin": "\xff\x00\xfe", "utf8": "h\u00e9", "cr": "a\r\n"},
+	}
+	for i, kvStore := range stores {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		if err := writeDump(path, kvStore, sortedKeys(kvStore)); err != nil {
+			t.Fatalf("store %d: writeDump: %v", i, err)
+		}
+		loaded, err := loadJSON(path)
+		if err != nil {
+			t.Fatalf("store %d: loadJSON: %v", i, err)
+		}
+		if !reflect.DeepEqual(loaded, kvStore) {
+			t.Errorf("store %d: loaded %q, want %q", i, loaded, kvStore)
+		}
+	}
+}
+
+func TestDumpJSONBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	kvStore := map[string]string{"bin": "\xff\x00", "text": "x"}
+	if err := writeDump(path, kvStore, sortedKeys(kvStore)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"type": "bytes"`, `"value": "/wA="`, `"type": "string"`} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("dump does not contain %s:\n%s", want, data)
+		}
+	}
+}
+
+func TestDumpJSONCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"WRITEB64 bin /wA=\n"+
+		"DUMPJSON "+path+"\n"+
+		"FLUSHALL CONFIRM\n"+
+		"LOADJSON "+path+"\n"+
+		"READ a\n"+
+		"READB64 bin\n")
+	want := []string{"1", "/wA="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLoadJSONErrors(t *testing.T) {
+	tests := []struct {
+		dump string
+		want string
+	}{
+		{`{"version":1,"entries":[{"key":"k","type":"list","value":[]}]}`, `unknown type "list" of key k`},
+		{`{"version":99,"entries":[]}`, "unsupported dump version 99"},
+		{"{\n\"version\":1,\n\"entries\":[\n}", "line 4"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		if err := os.WriteFile(path, []byte(test.dump), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadJSON(path)
+		if err == nil || errorCode(err) != ERR_FORMAT || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("loadJSON(%s) = %v, want an %s error containing %q", test.dump, err, ERR_FORMAT, test.want)
+		}
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"WRITE b 2\n"+
+		"SCAN 1 9223372036854775807\n"+
+		"SCAN 0 COUNT 9223372036854775807\n"+
+		"SCAN 0 1\n")
+	want := []string{"0", "b", "0", "a", "b", "1", "a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestScanValuesHugeCount(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"WRITE b 2\n"+
+		"SCANVALUES 1 9223372036854775807\n")
+	want := []string{"0", "b 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChainedInput(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a <<END; READ a; INSERT; READ b\n"+
+		"1\n"+
+		"END\n"+
+		"b 2\n"+
+		".\n")
+	want := []string{"1", "Inserted: 1 pairs", "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChainedTransaction(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE x 0; TRANSACTION WRITE b 2; DELETE nope; WRITE c 3\n"+
+		"READ x\n"+
+		"READDEFAULT b unset\n"+
+		"READDEFAULT c unset\n")
+	want := []string{
+		"ERR_NOT_FOUND: TRANSACTION rolled back at command 2 (DELETE nope): Key not found: nope",
+		"0",
+		"unset",
+		"unset",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidateTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script")
+	script := "TRANSACTION WRITE a <<END; READ\n" +
+		"TRANSACTION WRITE a 1; MULTI\n" +
+		"TRANSACTION WRITE a <<A; WRITE b <<B\n" +
+		"A\n" +
+		"READ\n" +
+		"B\n" +
+		"READ a\n"
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	out = &buf
+	defer func() { out = os.Stdout }()
+
+	invalid, err := validate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := path + ":1: ERR_PARSE: too few arguments, usage: READ <key>\n" +
+		path + ":2: ERR_TXN: Command not allowed in TRANSACTION: MULTI\n"
+	if invalid != 2 || buf.String() != want {
+		t.Errorf("validate = %d, printing:\n%s\nwant 2, printing:\n%s", invalid, buf.String(), want)
+	}
+}
+
+func TestLoadJSONASCIIOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	kvStore := map[string]string{"a": "1", "b": "h\u00e9"}
+	if err := writeDump(path, kvStore, sortedKeys(kvStore)); err != nil {
+		t.Fatal(err)
+	}
+	asciiOnly = true
+	defer func() { asciiOnly = false }()
+
+	got := runScript(t, newRoot(), "WRITE c 3\n"+
+		"LOADJSON "+path+"\n"+
+		"READDEFAULT a unset\n"+
+		"READ c\n")
+	want := []string{
+		"ERR_PARSE: non-ASCII byte 0xc3 at position 2 of h\u00e9",
+		"unset",
+		"3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplayASCIIOnly(t *testing.T) {
+	dir := t.TempDir()
+	valueFile := filepath.Join(dir, "value")
+	if err := os.WriteFile(valueFile, []byte("h\u00e9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asciiOnly = true
+	defer func() { asciiOnly = false }()
+
+	logs := []string{
+		"WRITE a 1\nWRITE b h\u00e9\n",
+		"WRITE a 1\nWRITEB64 b aMOp\n",
+		"WRITE a 1\nWRITE b @" + valueFile + "\n",
+		"WRITE a 1\nWRITE b <<END\nh\u00e9\nEND\n",
+	}
+	for _, log := range logs {
+		path := filepath.Join(dir, "log")
+		if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got := runScript(t, newRoot(), "REPLAY "+path+"\n"+
+			"READDEFAULT a unset\n")
+		want := []string{"ERR_PARSE: non-ASCII byte 0xc3 at position 2 of h\u00e9", "unset"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("replaying %q: got %q, want %q", log, got, want)
+		}
+	}
+}
+
+func TestAliasCommandName(t *testing.T) {
+	a := aliasFlag{}
+	if err := a.Set("R=READ,read2=READ"); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"READ=DELETE", "write=DELETE"} {
+		if err := a.Set(value); err == nil || !strings.Contains(err.Error(), "already a command") {
+			t.Errorf("Set(%q) = %v, want an error naming a command", value, err)
+		}
+	}
+	if got := a.String(); got != "R=READ,READ2=READ" {
+		t.Errorf("aliases = %s, want R=READ,READ2=READ", got)
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	empty, spaced, key := "", "a b", "a"
+	tests := []struct {
+		req  request
+		want string
+	}{
+		{request{Cmd: "WRITE", Key: &key, Value: &spaced}, ""},
+		{request{Cmd: "WRITE", Key: &key, Value: &empty}, ""},
+		{request{Cmd: "WRITE", Key: &empty, Value: &key}, "empty key"},
+		{request{Cmd: "WRITE", Key: &spaced, Value: &key}, "whitespace in key"},
+		{request{Cmd: "READ a"}, "whitespace in cmd"},
+		{request{Cmd: "SCAN", Args: []string{"0", "2\t3"}}, "whitespace in args"},
+	}
+	for _, test := range tests {
+		err := checkRequest(test.req)
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("checkRequest(%+v) = %v, want %q", test.req, err, test.want)
+		}
+	}
+}
+
+func TestReadOnlyReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	if err := os.WriteFile(path, []byte("WRITE a 1\nWRITE b 2\nDELETE a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readOnly = true
+	defer func() { readOnly = false }()
+
+	got := runScript(t, newRoot(), "WRITE c 3\n"+
+		"REPLAY "+path+"\n"+
+		"READ b\n")
+	want := []string{
+		"ERR_READ_ONLY: WRITE changes the store, which is read-only",
+		"Replayed: 3 mutations",
+		"2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
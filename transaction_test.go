@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"START\n"+
+		"WRITE a 2\n"+
+		"READ a\n"+
+		"START\n"+
+		"DELETE a\n"+
+		"READDEFAULT a unset\n"+
+		"ABORT\n"+
+		"READ a\n"+
+		"ABORT\n"+
+		"READ a\n")
+	want := []string{
+		"2",
+		"unset",
+		"Aborted: 1 pending changes discarded",
+		"2",
+		"Aborted: 1 pending changes discarded",
+		"1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCommitVisibility(t *testing.T) {
+	root := newRoot()
+	got := runScript(t, root, "START\n"+
+		"WRITE a 1\n"+
+		"START\n"+
+		"WRITE b 2\n"+
+		"COMMIT\n"+
+		"READ b\n"+
+		"COMMIT\n"+
+		"READ a\n"+
+		"READ b\n")
+	want := []string{
+		"Committed: 1 added, 0 modified, 0 deleted",
+		"2",
+		"Committed: 2 added, 0 modified, 0 deleted",
+		"1",
+		"2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestRepeatableRead changes the parent of an open transaction directly,
+// since commands from a single input cannot.
+func TestRepeatableRead(t *testing.T) {
+	root := newRoot()
+	root.store["a"] = "1"
+	child := root.begin()
+	root.store["a"] = "2"
+	root.store["b"] = "3"
+
+	if got := runScript(t, child, "READ a\nREAD b\n"); !reflect.DeepEqual(got, []string{"1", "ERR_NOT_FOUND: Key not found: b"}) {
+		t.Errorf("transaction saw %q, want its snapshot", got)
+	}
+	if got := runScript(t, root.begin(), "READ a\nREAD b\n"); !reflect.DeepEqual(got, []string{"2", "3"}) {
+		t.Errorf("new transaction saw %q, want the parent's writes", got)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"TRANSACTION WRITE a 2; WRITE b 2; FOO x\n"+
+		"TRANSACTION WRITE a 3; START\n"+
+		"TRANSACTION WRITE a 4; DELETE b; WRITE c 4\n"+
+		"READ a\n"+
+		"READDEFAULT b unset\n"+
+		"READDEFAULT c unset\n"+
+		"TRANSACTION WRITE a 5; ; WRITE b 5\n"+
+		"READ a\n"+
+		"READ b\n")
+	want := []string{
+		"ERR_UNKNOWN_COMMAND: TRANSACTION rolled back at command 3 (FOO x): Unrecognized command: FOO",
+		"ERR_TXN: TRANSACTION rolled back at command 2 (START): Command not allowed in TRANSACTION: START",
+		"ERR_NOT_FOUND: TRANSACTION rolled back at command 2 (DELETE b): Key not found: b",
+		"1",
+		"unset",
+		"unset",
+		"5",
+		"5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	got := runScript(t, newRoot(), "WRITE a 1\n"+
+		"MULTI\n"+
+		"WRITE a 2\n"+
+		"READ\n"+
+		"WRITE b <<END\n"+
+		"x\n"+
+		"END\n"+
+		"EXEC\n"+
+		"READ a\n"+
+		"READDEFAULT b unset\n"+
+		"MULTI\n"+
+		"WRITE a 3\n"+
+		"DISCARD\n"+
+		"READ a\n"+
+		"MULTI\n"+
+		"WRITE b <<END\n"+
+		"x\n"+
+		"END\n"+
+		"INSERT\n"+
+		"c 3\n"+
+		".\n"+
+		"EXEC\n"+
+		"READ b\n"+
+		"READ c\n"+
+		"EXEC\n")
+	want := []string{
+		"QUEUED",
+		"ERR_PARSE: too few arguments, usage: READ <key>",
+		"QUEUED",
+		"ERR_TXN: EXEC discarded, a queued command had errors",
+		"1",
+		"unset",
+		"QUEUED",
+		"1",
+		"QUEUED",
+		"QUEUED",
+		"Inserted: 1 pairs",
+		"x",
+		"3",
+		"ERR_TXN: EXEC without MULTI",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestCommitLevels checks that a COMMIT of several levels is recorded and kept
+// in the key history only once it reaches the store, and not if an enclosing
+// transaction is aborted.
+func TestCommitLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	historySize = 5
+	defer func() {
+		historySize, keyHistory = 0, make(map[string][]keyChange)
+	}()
+
+	got := runScript(t, newRoot(), "RECORD "+path+"\n"+
+		"WRITE levels 0\n"+
+		"START\n"+
+		"WRITE levels 1\n"+
+		"START\n"+
+		"START\n"+
+		"WRITE levels 3\n"+
+		"COMMIT 2\n"+
+		"READ levels\n"+
+		"ABORT\n"+
+		"HISTORY levels\n"+
+		"READ levels\n"+
+		"START\n"+
+		"START\n"+
+		"WRITE levels 4\n"+
+		"COMMIT 2\n"+
+		"HISTORY levels\n"+
+		"READ levels\n"+
+		"COMMIT 1\n"+
+		"RECORD STOP\n")
+	want := []string{
+		"Committed: 0 added, 1 modified, 0 deleted",
+		"3",
+		"Aborted: 1 pending changes discarded",
+		"0",
+		"Committed: 0 added, 1 modified, 0 deleted",
+		"0",
+		"4",
+		"ERR_TXN: you are not currently in a transaction",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "WRITE levels 0\nWRITE levels 4\n"; string(data) != want {
+		t.Errorf("recorded %q, want %q", data, want)
+	}
+}
+
+// TestAbortOnError checks where the commands following a failing one run,
+// since the errors inside a transaction go to stderr.
+func TestAbortOnError(t *testing.T) {
+	script := "WRITE a 0\n" +
+		"START\n" +
+		"WRITE a 1\n" +
+		"START\n" +
+		"WRITE a 2\n" +
+		"DELETE nope\n" +
+		"READ a\n" +
+		"COMMIT\n" +
+		"READ a\n" +
+		"COMMIT\n"
+	if got, want := runScript(t, newRoot(), script), []string{
+		"2",
+		"Committed: 0 added, 1 modified, 0 deleted",
+		"2",
+		"Committed: 0 added, 1 modified, 0 deleted",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without -abort-on-error got %q, want %q", got, want)
+	}
+
+	abortOnError = true
+	defer func() { abortOnError = false }()
+	if got, want := runScript(t, newRoot(), script), []string{
+		"1",
+		"Committed: 0 added, 1 modified, 0 deleted",
+		"1",
+		"ERR_TXN: you are not currently in a transaction",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with -abort-on-error got %q, want %q", got, want)
+	}
+}